@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,16 +13,23 @@ import (
 	"github.com/hellofresh/health-go/v5"
 	"github.com/kelseyhightower/envconfig"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/mmcdole/gofeed"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/piraces/rsslay/internal/handlers"
+	"github.com/piraces/rsslay/pkg/events"
 	"github.com/piraces/rsslay/pkg/feed"
 	"github.com/piraces/rsslay/pkg/replayer"
+	"github.com/piraces/rsslay/pkg/scheduler"
+	"github.com/piraces/rsslay/pkg/signer"
+	"github.com/piraces/rsslay/pkg/websub"
 	"github.com/piraces/rsslay/scripts"
-	"golang.org/x/exp/slices"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -33,7 +41,15 @@ var (
 )
 
 type Relay struct {
-	Secret                          string   `envconfig:"SECRET" required:"true"`
+	Secret                          string   `envconfig:"SECRET" default:""`
+	SecretVersion                   int      `envconfig:"SECRET_VERSION" default:"1"`
+	PreviousSecrets                 []string `envconfig:"PREVIOUS_SECRETS" default:""`
+	KeyEncryptionKey                string   `envconfig:"KEY_ENCRYPTION_KEY" default:""`
+	RemoteSigner                    string   `envconfig:"REMOTE_SIGNER" default:""`
+	RemoteSignerKey                 string   `envconfig:"REMOTE_SIGNER_KEY" default:""`
+	BunkerKey                       string   `envconfig:"BUNKER_KEY" default:""`
+	BunkerRelay                     string   `envconfig:"BUNKER_RELAY" default:""`
+	BunkerClients                   []string `envconfig:"BUNKER_CLIENTS" default:""`
 	DatabaseDirectory               string   `envconfig:"DB_DIR" default:"db/rsslay.sqlite"`
 	DefaultProfilePictureUrl        string   `envconfig:"DEFAULT_PROFILE_PICTURE_URL" default:"https://i.imgur.com/MaceU96.png"`
 	Version                         string   `envconfig:"VERSION" default:"unknown"`
@@ -46,13 +62,44 @@ type Relay struct {
 	MainDomainName                  string   `envconfig:"MAIN_DOMAIN_NAME" default:""`
 	OwnerPublicKey                  string   `envconfig:"OWNER_PUBLIC_KEY" default:""`
 	MaxSubroutines                  int      `envconfig:"MAX_SUBROUTINES" default:"20"`
+	DefaultPollInterval             int64    `envconfig:"DEFAULT_POLL_INTERVAL" default:"1200000"`
+	MinPollInterval                 int64    `envconfig:"MIN_POLL_INTERVAL" default:"600000"`
+	MaxPollInterval                 int64    `envconfig:"MAX_POLL_INTERVAL" default:"86400000"`
+	PollJitter                      int64    `envconfig:"POLL_JITTER" default:"120000"`
+	MaxPollWorkers                  int      `envconfig:"MAX_POLL_WORKERS" default:"10"`
+	FeedDegradedAfterFailures       int      `envconfig:"FEED_DEGRADED_AFTER_FAILURES" default:"3"`
+	FeedSuspendedAfterFailures      int      `envconfig:"FEED_SUSPENDED_AFTER_FAILURES" default:"10"`
+	FeedDeadAfter                   int64    `envconfig:"FEED_DEAD_AFTER" default:"2592000000"`
+	DeleteDeadFeeds                 bool     `envconfig:"DELETE_DEAD_FEEDS" default:"false"`
+	EnableWebSub                    bool     `envconfig:"ENABLE_WEBSUB" default:"false"`
+	WebSubLeaseSeconds              int      `envconfig:"WEBSUB_LEASE_SECONDS" default:"864000"`
+	LongFormArticles                string   `envconfig:"LONG_FORM_ARTICLES" default:"disabled"`
+	MaxNoteLength                   int      `envconfig:"MAX_NOTE_LENGTH" default:"250"`
+	MaxHashtags                     int      `envconfig:"MAX_HASHTAGS" default:"5"`
+	HashtagBlocklist                []string `envconfig:"HASHTAG_BLOCKLIST" default:"uncategorized,uncategorised,general,misc,other,default"`
+	AppendHashtags                  bool     `envconfig:"APPEND_HASHTAGS" default:"false"`
+	DefaultQueryLimit               int      `envconfig:"DEFAULT_QUERY_LIMIT" default:"100"`
+	MaxQueryLimit                   int      `envconfig:"MAX_QUERY_LIMIT" default:"500"`
+	RelayName                       string   `envconfig:"RELAY_NAME" default:"rsslay"`
+	RelayDescription                string   `envconfig:"RELAY_DESCRIPTION" default:"Nostr relay that creates virtual nostr profiles for each RSS feed submitted"`
+	RelayContact                    string   `envconfig:"RELAY_CONTACT" default:""`
+	ItemDeletionGracePeriod         int64    `envconfig:"ITEM_DELETION_GRACE_PERIOD" default:"86400000"`
+	EditedItems                     string   `envconfig:"EDITED_ITEMS" default:"ignore"`
 
 	updates            chan nostr.Event
-	lastEmitted        sync.Map
 	db                 *sql.DB
+	keyring            feed.Keyring
+	keys               feed.KeyStore
+	signer             signer.Signer
+	relaySigner        signer.Signer
+	remotes            *signer.Remotes
 	healthCheck        *health.Health
 	mutex              sync.Mutex
 	routineQueueLength int
+	scheduler          *scheduler.Scheduler
+	websub             *websub.Subscriber
+	replayMutex        sync.Mutex
+	pendingReplay      []nostr.Event
 }
 
 var relayInstance = &Relay{
@@ -76,29 +123,62 @@ func CreateHealthCheck() {
 }
 
 func (r *Relay) Name() string {
-	return "rsslay"
+	// relayer asks for the name before Init reads the environment.
+	if r.RelayName == "" {
+		return "rsslay"
+	}
+	return r.RelayName
 }
 
 func (r *Relay) OnInitialized(s *relayer.Server) {
+	s.Router().Use(handlers.Nip11Middleware(r.informationDocument()))
 	s.Router().Path("/").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		handlers.HandleWebpage(writer, request, r.db)
 	})
 	s.Router().Path("/create").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		handlers.HandleCreateFeed(writer, request, r.db, &r.Secret, dsn)
+		handlers.HandleCreateFeed(writer, request, r.db, r.keys, r.remotes, dsn)
 	})
 	s.Router().Path("/search").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		handlers.HandleSearch(writer, request, r.db)
 	})
+	s.Router().Path("/claim").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handlers.HandleClaim(writer, request, r.db, r.keys, dsn)
+	})
 	s.Router().Path("/favicon.ico").HandlerFunc(handlers.HandleFavicon)
 	s.Router().Path("/healthz").HandlerFunc(relayInstance.healthCheck.HandlerFunc)
 	s.Router().Path("/api/feed").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		handlers.HandleApiFeed(writer, request, r.db, &r.Secret, dsn)
+		handlers.HandleApiFeed(writer, request, r.db, r.keys, r.remotes, dsn)
 	})
+	if r.websub != nil {
+		s.Router().PathPrefix("/websub/").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			handlers.HandleWebSubCallback(writer, request, r.websub, dsn)
+		})
+	}
 	s.Router().Path("/.well-known/nostr.json").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		handlers.HandleNip05(writer, request, r.db, &r.OwnerPublicKey, &r.EnableAutoNIP05Registration)
 	})
 }
 
+// informationDocument returns the NIP-11 document of the relay, which only
+// serves the events it creates from feeds.
+func (r *Relay) informationDocument() *handlers.RelayInformationDocument {
+	return &handlers.RelayInformationDocument{
+		RelayInformationDocument: nip11.RelayInformationDocument{
+			Name:          r.RelayName,
+			Description:   r.RelayDescription,
+			PubKey:        r.OwnerPublicKey,
+			Contact:       r.RelayContact,
+			SupportedNIPs: []int{1, 9, 11, 12, 15, 16, 20, 23, 33, 40, 45},
+			Software:      "https://github.com/piraces/rsslay",
+			Version:       r.Version,
+		},
+		Limitation: &handlers.RelayLimitation{
+			MaxLimit:         r.MaxQueryLimit,
+			RestrictedWrites: true,
+		},
+	}
+}
+
 func (r *Relay) Init() error {
 	flag.Parse()
 	err := envconfig.Process("", r)
@@ -108,64 +188,505 @@ func (r *Relay) Init() error {
 		log.Printf("Running VERSION %s:\n - DSN=%s\n - DB_DIR=%s\n\n", r.Version, *dsn, r.DatabaseDirectory)
 	}
 
+	// With a bunker, the secrets and keys of feeds are only known to it
+	if r.RemoteSigner == "" {
+		if r.keyring, err = feed.NewKeyring(r.Secret, r.SecretVersion, r.PreviousSecrets); err != nil {
+			return fmt.Errorf("invalid SECRET, SECRET_VERSION or PREVIOUS_SECRETS: %w", err)
+		}
+		if r.keyring.Cipher, err = feed.NewKeyCipher(r.KeyEncryptionKey); err != nil {
+			return fmt.Errorf("invalid KEY_ENCRYPTION_KEY: %w", err)
+		}
+	} else if r.Secret != "" || r.KeyEncryptionKey != "" || strings.Join(r.PreviousSecrets, "") != "" {
+		log.Print("SECRET, PREVIOUS_SECRETS and KEY_ENCRYPTION_KEY are ignored with REMOTE_SIGNER, unset them here and set them in the bunker")
+	}
+	if r.relaySigner, err = r.newSigner(); err != nil {
+		return fmt.Errorf("invalid REMOTE_SIGNER or REMOTE_SIGNER_KEY: %w", err)
+	}
+	if r.RemoteSignerKey != "" {
+		// Feeds can also be created with keys held by the bunkers of their owners
+		clientPubKey, err := nostr.GetPublicKey(r.RemoteSignerKey)
+		if err != nil {
+			return errors.New("invalid REMOTE_SIGNER_KEY, expected a private key in hex")
+		}
+		log.Printf("bunkers of feed owners must allow client %s", clientPubKey)
+	}
+	r.remotes = &signer.Remotes{ClientKey: r.RemoteSignerKey, Timeout: 10 * time.Second}
+	r.signer = signer.Routed(r.feedSigner)
+	if _, err := feed.ParseArticleMode(r.LongFormArticles); err != nil || r.LongFormArticles == "" {
+		return fmt.Errorf("invalid LONG_FORM_ARTICLES, expected one of %q, %q or %q", feed.ArticlesDisabled, feed.ArticlesAdditional, feed.ArticlesInstead)
+	}
+	if _, err := feed.ParseEditPolicy(r.EditedItems); err != nil || r.EditedItems == "" {
+		return fmt.Errorf("invalid EDITED_ITEMS, expected one of %q, %q or %q", feed.EditsIgnore, feed.EditsCorrect, feed.EditsReplace)
+	}
+
 	r.db = InitDatabase(r)
+	if remote, ok := r.relaySigner.(*signer.Remote); ok {
+		r.keys = &feed.RemoteKeys{Call: remote.Call}
+	} else {
+		r.keys = &feed.LocalKeys{Keyring: &r.keyring, DB: r.db}
+	}
+	// Replicas can't write, they get the encrypted keys from the primary
+	if r.RemoteSigner == "" && isPrimary() {
+		if encrypted, err := feed.EncryptStoredKeys(r.keyring.Cipher, r.db); err != nil {
+			return fmt.Errorf("failed to encrypt private keys: %w", err)
+		} else if encrypted > 0 {
+			log.Printf("encrypted the private keys of %d feeds", encrypted)
+		}
+	}
 
-	go r.UpdateListeningFilters()
+	// Polls subscribe feeds to their hubs, so the subscriber is needed first
+	if r.EnableWebSub {
+		r.websub = &websub.Subscriber{
+			DB:           r.db,
+			CallbackURL:  fmt.Sprintf("https://%s/websub/", r.MainDomainName),
+			LeaseSeconds: r.WebSubLeaseSeconds,
+			RenewBefore:  time.Duration(r.MaxPollInterval) * time.Millisecond * 2,
+			OnContent:    r.receiveWebSubContent,
+			Client:       &http.Client{Timeout: 10 * time.Second},
+		}
+		go r.renewWebSubLeases()
+	}
+
+	r.scheduler = &scheduler.Scheduler{
+		DB:           r.db,
+		Poll:         r.pollFeed,
+		Interval:     time.Duration(r.DefaultPollInterval) * time.Millisecond,
+		MinInterval:  time.Duration(r.MinPollInterval) * time.Millisecond,
+		MaxInterval:  time.Duration(r.MaxPollInterval) * time.Millisecond,
+		Jitter:       time.Duration(r.PollJitter) * time.Millisecond,
+		Workers:      r.MaxPollWorkers,
+		TickInterval: time.Minute,
+		Health: feed.HealthThresholds{
+			DegradedAfter:  r.FeedDegradedAfterFailures,
+			SuspendedAfter: r.FeedSuspendedAfterFailures,
+			DeadAfter:      time.Duration(r.FeedDeadAfter) * time.Millisecond,
+		},
+		DeleteDeadFeeds: r.DeleteDeadFeeds,
+		OnDelete:        r.unsubscribeDeletedFeed,
+		ShouldRun:       isPrimary,
+	}
+	r.scheduler.Start(context.Background())
+
+	go r.replayPending()
+	go r.purgeExpiredEvents()
 
 	return nil
 }
 
-func (r *Relay) UpdateListeningFilters() {
+// newSigner returns the signer of the events of feeds: a NIP-46 bunker when
+// REMOTE_SIGNER is set, which also creates and exports their keys, or the
+// private keys stored for feeds otherwise.
+func (r *Relay) newSigner() (signer.Signer, error) {
+	if r.RemoteSigner == "" {
+		return r.localSigner(), nil
+	}
+
+	bunkerPubKey, relayUrl, err := signer.ParseBunkerURL(r.RemoteSigner)
+	if err != nil {
+		return nil, err
+	}
+	clientPubKey, err := nostr.GetPublicKey(r.RemoteSignerKey)
+	if err != nil || r.RemoteSignerKey == "" {
+		return nil, errors.New("REMOTE_SIGNER_KEY must be a private key in hex")
+	}
+	remote := &signer.Remote{
+		BunkerPublicKey: bunkerPubKey,
+		ClientKey:       r.RemoteSignerKey,
+		Transport:       &signer.RelayTransport{URL: relayUrl},
+		Timeout:         10 * time.Second,
+	}
+
+	log.Printf("signing events with bunker %s through %s as client %s", bunkerPubKey, relayUrl, clientPubKey)
+	go func() {
+		if err := remote.Ping(context.Background()); err != nil {
+			log.Printf("bunker %s is not answering yet: %v", bunkerPubKey, err)
+		}
+	}()
+	return remote, nil
+}
+
+// feedSigner returns the signer of the events of a feed: the bunker of its
+// owner when the feed was created with a key held there, or the signer of the
+// relay otherwise.
+func (r *Relay) feedSigner(pubkey string) (signer.Signer, error) {
+	if bunker := feed.Bunker(pubkey, r.db); bunker != "" {
+		return r.remotes.Get(bunker)
+	}
+	return r.relaySigner, nil
+}
+
+// localSigner signs events with the private keys stored for feeds.
+func (r *Relay) localSigner() signer.Signer {
+	return &signer.Local{Key: func(pubkey string) (string, error) {
+		return feed.StoredPrivateKey(pubkey, r.keyring.Cipher, r.db)
+	}}
+}
+
+// pollFeed is called by the scheduler for every feed when it is due, notifying
+// listeners and queueing for replay the events not seen before.
+func (r *Relay) pollFeed(entity feed.Entity) (*gofeed.Feed, error) {
+	parsedFeed, validators, err := feed.FetchFeed(entity.URL, feed.GetCacheValidators(entity.URL, r.db))
+	if errors.Is(err, feed.ErrNotModified) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	polledAt := time.Now()
+	newEvents, err := r.processFeed(entity, parsedFeed)
+	if err != nil {
+		// The feed is fetched in full again on the next poll
+		r.publish(newEvents)
+		return nil, err
+	}
+	feed.SaveCacheValidators(entity.URL, validators, r.db)
+	r.publish(append(newEvents, r.deleteMissingItems(entity, polledAt)...))
+
+	if r.websub != nil {
+		hub, topic := feed.WebSubHub(parsedFeed, entity.URL)
+		if err := r.websub.EnsureSubscribed(entity.PublicKey, hub, topic); err != nil {
+			log.Printf("failed to subscribe to hub %q for feed %q: %v", hub, entity.URL, err)
+		}
+	}
+
+	return parsedFeed, nil
+}
+
+// receiveWebSubContent processes the content pushed by a WebSub hub like the
+// result of a poll.
+func (r *Relay) receiveWebSubContent(pubkey string, content io.Reader) error {
+	entity, ok := r.getFeed(pubkey)
+	if !ok {
+		return fmt.Errorf("feed with pubkey %s not found", pubkey)
+	}
+
+	parsedFeed, err := feed.ParseContent(content)
+	if err != nil {
+		return err
+	}
+
+	newEvents, err := r.processFeed(entity, parsedFeed)
+	r.publish(newEvents)
+	return err
+}
+
+func (r *Relay) publish(newEvents []nostr.Event) {
+	for _, evt := range newEvents {
+		r.updates <- evt
+	}
+	r.queueReplay(newEvents)
+}
+
+func (r *Relay) queueReplay(newEvents []nostr.Event) {
+	r.replayMutex.Lock()
+	defer r.replayMutex.Unlock()
+	r.pendingReplay = append(r.pendingReplay, newEvents...)
+}
+
+// replayPending periodically replays the events gathered from all polls as a
+// single batch, instead of one batch per polled feed.
+func (r *Relay) replayPending() {
+	for {
+		time.Sleep(time.Duration(r.DefaultWaitTimeBetweenBatches) * time.Millisecond)
+
+		r.replayMutex.Lock()
+		pending := r.pendingReplay
+		r.pendingReplay = nil
+		r.replayMutex.Unlock()
+
+		r.AttemptReplayEvents(pending)
+	}
+}
+
+// purgeExpiredEvents periodically deletes the events of feeds with a TTL once
+// their NIP-40 expiration has passed. They are not served after that anyway.
+func (r *Relay) purgeExpiredEvents() {
 	for {
-		time.Sleep(20 * time.Minute)
-
-		filters := relayer.GetListeningFilters()
-		log.Printf("checking for updates; %d filters active", len(filters))
-
-		var events []replayer.EventWithPrivateKey
-		for _, filter := range filters {
-			if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
-				for _, pubkey := range filter.Authors {
-					pubkey = strings.TrimSpace(pubkey)
-					row := r.db.QueryRow("SELECT privatekey, url FROM feeds WHERE publickey=$1", pubkey)
-
-					var entity feed.Entity
-					err := row.Scan(&entity.PrivateKey, &entity.URL)
-					if err != nil && err == sql.ErrNoRows {
-						continue
-					} else if err != nil {
-						log.Fatalf("failed when trying to retrieve row with pubkey '%s': %v", pubkey, err)
-					}
-
-					parsedFeed, err := feed.ParseFeed(entity.URL)
-					if err != nil {
-						log.Printf("failed to parse feed at url %q: %v", entity.URL, err)
-						feed.DeleteInvalidFeed(entity.URL, r.db)
-						continue
-					}
-
-					for _, item := range parsedFeed.Items {
-						defaultCreatedAt := time.Now()
-						evt := feed.ItemToTextNote(pubkey, item, parsedFeed, defaultCreatedAt, entity.URL)
-						last, ok := r.lastEmitted.Load(entity.URL)
-						if last == nil {
-							last = uint32(time.Now().Unix())
-						}
-						if !ok || time.Unix(int64(last.(uint32)), 0).Before(evt.CreatedAt) {
-							_ = evt.Sign(entity.PrivateKey)
-							r.updates <- evt
-							r.lastEmitted.Store(entity.URL, last.(uint32))
-							events = append(events, replayer.EventWithPrivateKey{Event: evt, PrivateKey: entity.PrivateKey})
-						}
-					}
+		time.Sleep(time.Hour)
+		if !isPrimary() {
+			continue
+		}
+
+		if deleted, err := events.DeleteExpired(r.db, time.Now()); err != nil {
+			log.Printf("%v", err)
+		} else if deleted > 0 {
+			log.Printf("deleted %d expired events", deleted)
+		}
+	}
+}
+
+// unsubscribeDeletedFeed asks the WebSub hub of a deleted feed to stop sending
+// its notifications.
+func (r *Relay) unsubscribeDeletedFeed(pubkey string) {
+	if r.websub == nil {
+		// Without WebSub the hub is not asked, the subscription is just forgotten
+		if _, err := r.db.Exec(`DELETE FROM websub_subscriptions WHERE publickey=?`, pubkey); err != nil {
+			log.Printf("failed to delete subscription of deleted feed %s: %v", pubkey, err)
+		}
+		return
+	}
+	if err := r.websub.Unsubscribe(pubkey); err != nil {
+		log.Printf("failed to unsubscribe deleted feed %s: %v", pubkey, err)
+	}
+}
+
+// renewWebSubLeases periodically renews the WebSub subscriptions about to
+// expire, as polls don't when feeds keep answering they haven't changed.
+func (r *Relay) renewWebSubLeases() {
+	for {
+		time.Sleep(10 * time.Minute)
+		if !isPrimary() {
+			continue
+		}
+
+		if renewed, err := r.websub.RenewSubscriptions(); err != nil {
+			log.Printf("%v", err)
+		} else if renewed > 0 {
+			log.Printf("renewed %d websub subscriptions", renewed)
+		}
+	}
+}
+
+// isPrimary reports whether this node can write to the database. When running
+// under LiteFS, replicas have a ".primary" file next to the database.
+func isPrimary() bool {
+	if *dsn == "" {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(*dsn), ".primary"))
+	return os.IsNotExist(err)
+}
+
+func (r *Relay) getFeed(pubkey string) (feed.Entity, bool) {
+	pubkey = strings.TrimSpace(pubkey)
+	row := r.db.QueryRow("SELECT privatekey, url FROM feeds WHERE publickey=$1", pubkey)
+
+	entity := feed.Entity{PublicKey: pubkey}
+	err := row.Scan(&entity.PrivateKey, &entity.URL)
+	if err != nil && err == sql.ErrNoRows {
+		return entity, false
+	} else if err != nil {
+		log.Fatalf("failed when trying to retrieve row with pubkey '%s': %v", pubkey, err)
+	}
+
+	return entity, true
+}
+
+// processFeed converts the profile and items of a parsed feed into signed
+// events and stores them, returning only the ones not stored before. Items
+// failing to be signed or stored don't stop the others, but make it return an
+// error once done, so the feed is processed again.
+func (r *Relay) processFeed(entity feed.Entity, parsedFeed *gofeed.Feed) ([]nostr.Event, error) {
+	var newEvents []nostr.Event
+	failures := 0
+	fail := func(format string, v ...any) {
+		log.Printf(format, v...)
+		failures++
+	}
+	delegation := feed.Delegation(entity.PublicKey, r.db)
+	sign := func(evt *nostr.Event) bool {
+		feed.Delegate(evt, delegation)
+		if err := r.signer.Sign(context.Background(), evt); err != nil {
+			fail("failed to sign event from feed %q: %v", entity.URL, err)
+			return false
+		}
+		return true
+	}
+	save := func(evt nostr.Event, guid string) {
+		inserted, err := events.Save(r.db, evt, guid)
+		if err != nil {
+			fail("failed to store event from feed %q: %v", entity.URL, err)
+			return
+		}
+		if inserted {
+			newEvents = append(newEvents, evt)
+		}
+	}
+	store := func(evt nostr.Event, guid string) {
+		if sign(&evt) {
+			save(evt, guid)
+		}
+	}
+
+	// Owners holding the key of their feed keep the profile they set themselves
+	if !feed.KeyHeldByOwner(entity.PublicKey, r.db) {
+		metadata := feed.FeedToSetMetadata(entity.PublicKey, parsedFeed, entity.URL, r.EnableAutoNIP05Registration, r.DefaultProfilePictureUrl)
+		stored, err := events.Query(r.db, &nostr.Filter{Authors: []string{entity.PublicKey}, Kinds: []int{nostr.KindSetMetadata}, Limit: 1})
+		if err != nil || len(stored) == 0 || stored[0].Content != metadata.Content {
+			store(metadata, "")
+		}
+	}
+
+	options := feed.GetOptions(entity.URL, r.db)
+	articles := options.Articles
+	if articles == "" {
+		articles = feed.ArticleMode(r.LongFormArticles)
+	}
+	edits := options.Edits
+	if edits == "" {
+		edits = feed.EditPolicy(r.EditedItems)
+	}
+	settings := options.Settings(feed.Settings{
+		MaxNoteLength:    r.MaxNoteLength,
+		MaxHashtags:      r.MaxHashtags,
+		HashtagBlocklist: r.HashtagBlocklist,
+		AppendHashtags:   r.AppendHashtags,
+	})
+
+	now := time.Now()
+	if err := feed.RecordPresence(entity.PublicKey, parsedFeed.Items, now, r.db); err != nil {
+		fail("failed to record items from feed %q: %v", entity.URL, err)
+	}
+	for i, item := range parsedFeed.Items {
+		// Deleted items coming back would be hidden by clients anyway
+		if feed.IsDeleted(entity.PublicKey, item, r.db) {
+			continue
+		}
+
+		// Items without a date take the first time they were seen, minus their
+		// position so they keep the order of the feed
+		defaultCreatedAt := now
+		if item.PublishedParsed == nil && item.UpdatedParsed == nil {
+			firstSeen, err := feed.FirstSeen(entity.PublicKey, item, now.Add(-time.Duration(i)*time.Second), r.db)
+			if err != nil {
+				fail("failed to date item from feed %q: %v", entity.URL, err)
+				continue
+			}
+			defaultCreatedAt = firstSeen
+		}
+
+		edited, err := feed.IsEdited(entity.PublicKey, item, r.db)
+		if err != nil {
+			fail("failed to check edits of item from feed %q: %v", entity.URL, err)
+			continue
+		}
+		failed := failures
+
+		key := feed.ItemKey(item)
+		if articles != feed.ArticlesInstead {
+			note := feed.ItemToTextNote(entity.PublicKey, item, parsedFeed, defaultCreatedAt, entity.URL, settings)
+			previous, err := r.itemEvents(entity.PublicKey, key, nostr.KindTextNote)
+			switch {
+			case err != nil:
+				fail("failed to retrieve notes of item %q from feed %q: %v", key, entity.URL, err)
+			case len(previous) == 0:
+				store(note, key)
+			case !edited || edits == feed.EditsIgnore:
+				// Already published
+			case edits == feed.EditsCorrect:
+				store(feed.Correction(note, previous, feed.EditedAt(item, previous[0].CreatedAt, now)), key)
+			case edits == feed.EditsReplace:
+				deletion := feed.ItemDeletion(entity.PublicKey, previous, now, "Updated in the feed")
+				if !sign(&deletion) {
+					break
+				}
+				if err := events.ApplyDeletion(r.db, deletion); err != nil {
+					fail("failed to replace item %q from feed %q: %v", key, entity.URL, err)
+					break
 				}
+				save(deletion, "")
+				note.CreatedAt = feed.EditedAt(item, previous[0].CreatedAt, now)
+				store(note, key)
+			}
+		}
+		if articles != feed.ArticlesDisabled {
+			article := feed.ItemToArticle(entity.PublicKey, item, defaultCreatedAt, settings)
+			previous, err := r.itemEvents(entity.PublicKey, key, feed.KindArticle)
+			switch {
+			case err != nil:
+				fail("failed to retrieve article of item %q from feed %q: %v", key, entity.URL, err)
+			case len(previous) == 0:
+				store(article, key)
+			case edited:
+				// Replacements need a newer date to win over the previous article
+				article.CreatedAt = feed.EditedAt(item, previous[0].CreatedAt, now)
+				store(article, key)
+			}
+		}
+
+		// Edits are detected again until all their events are stored
+		if failures == failed {
+			if err := feed.RecordVersion(entity.PublicKey, item, r.db); err != nil {
+				fail("failed to record version of item %q from feed %q: %v", key, entity.URL, err)
+			}
+		}
+	}
+
+	if failures > 0 {
+		return newEvents, fmt.Errorf("%w: %d errors in feed %q", feed.ErrNotProcessed, failures, entity.URL)
+	}
+	return newEvents, nil
+}
+
+// itemEvents returns the events of the given kind stored for the item with the
+// given key, newest first.
+func (r *Relay) itemEvents(pubkey string, key string, kind int) ([]nostr.Event, error) {
+	published, err := events.ForItem(r.db, pubkey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []nostr.Event
+	for _, evt := range published {
+		if evt.Kind == kind {
+			matching = append(matching, evt)
+		}
+	}
+	return matching, nil
+}
+
+// deleteMissingItems deletes the events of the items removed from the feed for
+// longer than the grace period, if the feed opted in, returning the NIP-09
+// deletions to publish. Only full polls are considered, as hubs may push just
+// the new items.
+func (r *Relay) deleteMissingItems(entity feed.Entity, polledAt time.Time) []nostr.Event {
+	if !feed.GetOptions(entity.URL, r.db).DeleteMissingItems {
+		return nil
+	}
+
+	grace := time.Duration(r.ItemDeletionGracePeriod) * time.Millisecond
+	keys, err := feed.MissingItems(entity.PublicKey, polledAt, grace, r.db)
+	if err != nil {
+		log.Printf("failed to find items removed from feed %q: %v", entity.URL, err)
+		return nil
+	}
+
+	var deletions []nostr.Event
+	delegation := feed.Delegation(entity.PublicKey, r.db)
+	for _, key := range keys {
+		published, err := events.ForItem(r.db, entity.PublicKey, key)
+		if err != nil {
+			log.Printf("failed to retrieve events of item %q from feed %q: %v", key, entity.URL, err)
+			continue
+		}
+
+		if len(published) > 0 {
+			deletion := feed.ItemDeletion(entity.PublicKey, published, polledAt, "Removed from the feed")
+			feed.Delegate(&deletion, delegation)
+			if err := r.signer.Sign(context.Background(), &deletion); err != nil {
+				log.Printf("failed to sign deletion of item %q from feed %q: %v", key, entity.URL, err)
+				continue
+			}
+			if err := events.ApplyDeletion(r.db, deletion); err != nil {
+				log.Printf("failed to delete item %q from feed %q: %v", key, entity.URL, err)
+				continue
+			}
+			if _, err := events.Save(r.db, deletion, ""); err != nil {
+				log.Printf("failed to store deletion of item %q from feed %q: %v", key, entity.URL, err)
+				continue
 			}
+			deletions = append(deletions, deletion)
+		}
+
+		if err := feed.MarkDeleted(entity.PublicKey, key, polledAt, r.db); err != nil {
+			log.Printf("failed to delete item %q from feed %q: %v", key, entity.URL, err)
 		}
-		r.AttemptReplayEvents(events)
 	}
+
+	return deletions
 }
 
-func (r *Relay) AttemptReplayEvents(events []replayer.EventWithPrivateKey) {
+func (r *Relay) AttemptReplayEvents(events []nostr.Event) {
 	if relayInstance.ReplayToRelays && relayInstance.routineQueueLength < relayInstance.MaxSubroutines && len(events) > 0 {
 		r.routineQueueLength++
 		replayer.ReplayEventsToRelays(&replayer.ReplayParameters{
@@ -176,6 +697,7 @@ func (r *Relay) AttemptReplayEvents(events []replayer.EventWithPrivateKey) {
 			WaitTime:                 relayInstance.DefaultWaitTimeBetweenBatches,
 			WaitTimeForRelayResponse: relayInstance.DefaultWaitTimeForRelayResponse,
 			Events:                   events,
+			Signer:                   r.signer,
 		})
 	}
 }
@@ -184,6 +706,38 @@ func (r *Relay) AcceptEvent(_ *nostr.Event) bool {
 	return false
 }
 
+// HandleUnknownType answers NIP-45 COUNT requests with the number of stored
+// events matching any of their filters, without fetching any feed.
+func (r *Relay) HandleUnknownType(ws *relayer.WebSocket, typ string, request []json.RawMessage) {
+	if typ != "COUNT" {
+		_ = ws.WriteJSON([]any{"NOTICE", "unknown message type " + typ})
+		return
+	}
+
+	var id string
+	_ = json.Unmarshal(request[1], &id)
+	if id == "" {
+		_ = ws.WriteJSON([]any{"NOTICE", "COUNT has no <id>"})
+		return
+	}
+
+	filters := make(nostr.Filters, len(request)-2)
+	for i, filterReq := range request[2:] {
+		if err := json.Unmarshal(filterReq, &filters[i]); err != nil {
+			_ = ws.WriteJSON([]any{"NOTICE", "failed to decode filter"})
+			return
+		}
+	}
+
+	count, err := events.Count(r.db, filters)
+	if err != nil {
+		log.Printf("failed to count events: %v", err)
+		_ = ws.WriteJSON([]any{"NOTICE", "error: failed to count events"})
+		return
+	}
+	_ = ws.WriteJSON([]any{"COUNT", id, map[string]int64{"count": count}})
+}
+
 func (r *Relay) Storage() relayer.Storage {
 	return store{r.db}
 }
@@ -202,93 +756,200 @@ func (b store) DeleteEvent(_, _ string) error {
 }
 
 func (b store) QueryEvents(filter *nostr.Filter) ([]nostr.Event, error) {
-	var events []nostr.Event
-	var eventsToReplay []replayer.EventWithPrivateKey
-
-	if filter.IDs != nil || len(filter.Tags) > 0 {
-		return events, nil
-	}
 
+	// Feeds are kept up to date by the scheduler, only the ones just created
+	// need to be fetched before answering
 	for _, pubkey := range filter.Authors {
-		pubkey = strings.TrimSpace(pubkey)
-		row := relayInstance.db.QueryRow("SELECT privatekey, url FROM feeds WHERE publickey=$1", pubkey)
-
-		var entity feed.Entity
-		err := row.Scan(&entity.PrivateKey, &entity.URL)
-		if err != nil && err == sql.ErrNoRows {
+		if !relayInstance.scheduler.NeverPolled(strings.TrimSpace(pubkey)) {
 			continue
-		} else if err != nil {
-			log.Fatalf("failed when trying to retrieve row with pubkey '%s': %v", pubkey, err)
 		}
 
-		parsedFeed, err := feed.ParseFeed(entity.URL)
-		if err != nil {
-			log.Printf("failed to parse feed at url %q: %v", entity.URL, err)
-			feed.DeleteInvalidFeed(entity.URL, relayInstance.db)
+		entity, ok := relayInstance.getFeed(pubkey)
+		if !ok {
 			continue
 		}
 
-		if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindSetMetadata) {
-			evt := feed.FeedToSetMetadata(pubkey, parsedFeed, entity.URL, relayInstance.EnableAutoNIP05Registration, relayInstance.DefaultProfilePictureUrl)
+		if err := relayInstance.scheduler.PollNow(entity); err != nil {
+			log.Printf("failed to parse feed at url %q: %v", entity.URL, err)
+		}
+	}
 
-			if filter.Since != nil && evt.CreatedAt.Before(*filter.Since) {
-				continue
-			}
-			if filter.Until != nil && evt.CreatedAt.After(*filter.Until) {
-				continue
-			}
+	// Filters over every feed get the most recent events of all of them
+	query := *filter
+	if query.IDs == nil && len(query.Tags) == 0 && len(query.Authors) == 0 && query.Limit <= 0 {
+		query.Limit = relayInstance.DefaultQueryLimit
+	}
+	if query.Limit <= 0 || query.Limit > relayInstance.MaxQueryLimit {
+		query.Limit = relayInstance.MaxQueryLimit
+	}
 
-			_ = evt.Sign(entity.PrivateKey)
-			events = append(events, evt)
-			eventsToReplay = append(eventsToReplay, replayer.EventWithPrivateKey{Event: evt, PrivateKey: entity.PrivateKey})
-		}
+	return events.Query(b.db, &query)
+}
 
-		if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
-			var last uint32 = 0
-			for _, item := range parsedFeed.Items {
-				defaultCreatedAt := time.Now()
-				evt := feed.ItemToTextNote(pubkey, item, parsedFeed, defaultCreatedAt, entity.URL)
+func (r *Relay) InjectEvents() chan nostr.Event {
+	return r.updates
+}
 
-				// Feed need to have a date for each entry...
-				if evt.CreatedAt.Equal(defaultCreatedAt) {
-					continue
-				}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(runKeysCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bunker" {
+		os.Exit(runBunkerCommand(os.Args[2:]))
+	}
 
-				if filter.Since != nil && evt.CreatedAt.Before(*filter.Since) {
-					continue
-				}
-				if filter.Until != nil && evt.CreatedAt.After(*filter.Until) {
-					continue
-				}
+	CreateHealthCheck()
+	defer relayInstance.db.Close()
+	if err := relayer.Start(relayInstance); err != nil {
+		log.Fatalf("server terminated: %v", err)
+	}
+}
 
-				_ = evt.Sign(entity.PrivateKey)
+// runKeysCommand rotates the keys of feeds to another secret version in two
+// steps, so the rotation can be reviewed before it happens:
+//
+//	rsslay keys plan [-from VERSION] [-to VERSION] > plan.json
+//	rsslay keys apply plan.json
+//
+// Rotated feeds get a new identity, so this is meant for leaked secrets.
+func runKeysCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "plan" && args[0] != "apply") {
+		log.Print("usage: rsslay keys plan [-from VERSION] [-to VERSION] | rsslay keys apply PLAN")
+		return 2
+	}
 
-				if evt.CreatedAt.After(time.Unix(int64(last), 0)) {
-					last = uint32(evt.CreatedAt.Unix())
-				}
+	flags := flag.NewFlagSet("keys "+args[0], flag.ExitOnError)
+	flags.StringVar(dsn, "dsn", "", "datasource name")
+	from := flags.Int("from", 0, "only rotate the feeds of this secret version")
+	to := flags.Int("to", 0, "secret version to rotate to (defaults to SECRET_VERSION)")
+	_ = flags.Parse(args[1:])
 
-				events = append(events, evt)
-				eventsToReplay = append(eventsToReplay, replayer.EventWithPrivateKey{Event: evt, PrivateKey: entity.PrivateKey})
-			}
+	r := relayInstance
+	if err := envconfig.Process("", r); err != nil {
+		log.Printf("couldn't process envconfig: %v", err)
+		return 1
+	}
+	keyring, err := feed.NewKeyring(r.Secret, r.SecretVersion, r.PreviousSecrets)
+	if err != nil {
+		log.Printf("invalid SECRET, SECRET_VERSION or PREVIOUS_SECRETS: %v", err)
+		return 1
+	}
+	if keyring.Cipher, err = feed.NewKeyCipher(r.KeyEncryptionKey); err != nil {
+		log.Printf("invalid KEY_ENCRYPTION_KEY: %v", err)
+		return 1
+	}
+	r.db = InitDatabase(r)
+	defer r.db.Close()
 
-			relayInstance.lastEmitted.Store(entity.URL, last)
+	if args[0] == "plan" {
+		if *to == 0 {
+			*to = keyring.Current
 		}
+		plan, err := feed.PlanKeyRotation(keyring, *from, *to, r.db)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(plan)
+		log.Printf("planned the rotation of %d feeds to secret version %d, nothing has been changed yet", len(plan), *to)
+		return 0
 	}
 
-	relayInstance.AttemptReplayEvents(eventsToReplay)
+	if flags.NArg() != 1 {
+		log.Print("usage: rsslay keys apply PLAN")
+		return 2
+	}
+	content, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	var plan []feed.KeyRotation
+	if err := json.Unmarshal(content, &plan); err != nil {
+		log.Printf("invalid plan: %v", err)
+		return 1
+	}
 
-	return events, nil
+	failed := 0
+	for _, rotation := range plan {
+		if err := feed.ApplyKeyRotation(keyring, rotation, time.Now(), r.db); err != nil {
+			log.Printf("failed to rotate key of feed %q: %v", rotation.URL, err)
+			failed++
+			continue
+		}
+		log.Printf("rotated key of feed %q from %s (version %d) to %s (version %d)", rotation.URL, rotation.OldPublicKey, rotation.OldKeyVersion, rotation.NewPublicKey, rotation.NewKeyVersion)
+	}
+	log.Printf("rotated %d of %d feeds", len(plan)-failed, len(plan))
+	if failed > 0 {
+		return 1
+	}
+	return 0
 }
 
-func (r *Relay) InjectEvents() chan nostr.Event {
-	return r.updates
-}
+// runBunkerCommand runs a NIP-46 bunker signing the events of feeds with their
+// stored private keys, and deriving and exporting those keys, so the relay can
+// run with REMOTE_SIGNER without SECRET or KEY_ENCRYPTION_KEY:
+//
+//	rsslay bunker
+//
+// It answers the clients in BUNKER_CLIENTS through BUNKER_RELAY, as BUNKER_KEY.
+func runBunkerCommand(args []string) int {
+	flags := flag.NewFlagSet("bunker", flag.ExitOnError)
+	flags.StringVar(dsn, "dsn", "", "datasource name")
+	_ = flags.Parse(args)
+
+	r := relayInstance
+	if err := envconfig.Process("", r); err != nil {
+		log.Printf("couldn't process envconfig: %v", err)
+		return 1
+	}
+	var clients []string
+	for _, client := range r.BunkerClients {
+		if client = strings.TrimSpace(client); client != "" {
+			clients = append(clients, client)
+		}
+	}
+	bunkerPubKey, err := nostr.GetPublicKey(r.BunkerKey)
+	if err != nil || r.BunkerKey == "" || r.BunkerRelay == "" || len(clients) == 0 {
+		log.Print("BUNKER_KEY, BUNKER_RELAY and BUNKER_CLIENTS are required to run a bunker")
+		return 2
+	}
+	if r.keyring, err = feed.NewKeyring(r.Secret, r.SecretVersion, r.PreviousSecrets); err != nil {
+		log.Printf("invalid SECRET, SECRET_VERSION or PREVIOUS_SECRETS: %v", err)
+		return 1
+	}
+	if r.keyring.Cipher, err = feed.NewKeyCipher(r.KeyEncryptionKey); err != nil {
+		log.Printf("invalid KEY_ENCRYPTION_KEY: %v", err)
+		return 1
+	}
+	if r.keyring.Cipher == nil {
+		log.Print("without KEY_ENCRYPTION_KEY the private keys of feeds are stored in the clear, where the relay can read them")
+	}
+	r.db = InitDatabase(r)
+	if isPrimary() {
+		if encrypted, err := feed.EncryptStoredKeys(r.keyring.Cipher, r.db); err != nil {
+			log.Printf("failed to encrypt private keys: %v", err)
+			return 1
+		} else if encrypted > 0 {
+			log.Printf("encrypted the private keys of %d feeds", encrypted)
+		}
+	}
 
-func main() {
-	CreateHealthCheck()
-	defer relayInstance.db.Close()
-	if err := relayer.Start(relayInstance); err != nil {
-		log.Fatalf("server terminated: %v", err)
+	bunker := &signer.Bunker{
+		PrivateKey: r.BunkerKey,
+		Clients:    clients,
+		Signer:     r.localSigner(),
+		Transport:  &signer.RelayTransport{URL: r.BunkerRelay},
+		Methods:    feed.KeyStoreMethods(&feed.LocalKeys{Keyring: &r.keyring, DB: r.db}),
+	}
+	log.Printf("bunker listening at %s", signer.BunkerURL(bunkerPubKey, r.BunkerRelay))
+	for {
+		if err := bunker.Serve(context.Background()); err != nil {
+			log.Printf("bunker: %v", err)
+		}
+		time.Sleep(5 * time.Second)
 	}
 }
 
@@ -315,7 +976,7 @@ func InitDatabase(r *Relay) *sql.DB {
 	log.Printf("database opened at %s", *finalConnection)
 
 	// Run migration.
-	if _, err := sqlDb.Exec(scripts.SchemaSQL); err != nil {
+	if err := scripts.Migrate(sqlDb); err != nil {
 		log.Fatalf("cannot migrate schema: %v", err)
 	}
 
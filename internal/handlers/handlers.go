@@ -1,13 +1,20 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip05"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/piraces/rsslay/pkg/events"
 	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/piraces/rsslay/pkg/signer"
+	"github.com/piraces/rsslay/pkg/websub"
 	"github.com/piraces/rsslay/web/assets"
 	"github.com/piraces/rsslay/web/templates"
 	"html/template"
@@ -16,7 +23,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var t = template.Must(template.ParseFS(templates.Templates, "*.tmpl"))
@@ -30,10 +39,30 @@ type Entry struct {
 	ErrorCode    int
 }
 
+type ItemEntry struct {
+	NoteID    string
+	NPubKey   string
+	Url       string
+	Text      string
+	CreatedAt time.Time
+}
+
 type PageData struct {
 	Count         uint64
 	FilteredCount uint64
 	Entries       []Entry
+	Query         string
+	Items         []ItemEntry
+}
+
+type ClaimPage struct {
+	Claim        feed.Claim
+	PubKey       string
+	NPubKey      string
+	OwnerNPubKey string
+	WellKnownUrl string
+	Error        bool
+	ErrorMessage string
 }
 
 func HandleWebpage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
@@ -101,6 +130,7 @@ func HandleSearch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 
 	var items []Entry
+	found := map[string]bool{}
 	rows, err := db.Query(`SELECT publickey, url FROM feeds WHERE url like '%' || $1 || '%' LIMIT 50`, query)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -116,31 +146,92 @@ func HandleSearch(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 		entry.NPubKey, _ = nip19.EncodePublicKey(entry.PubKey)
 		items = append(items, entry)
+		found[entry.PubKey] = true
 	}
 	if err := rows.Close(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Feeds whose title or description match, from their profiles
+	profiles, err := events.Search(db, query, &nostr.Filter{Kinds: []int{nostr.KindSetMetadata}, Limit: 50})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, profile := range profiles {
+		if len(items) >= 50 || found[profile.PubKey] {
+			continue
+		}
+		entry := Entry{PubKey: profile.PubKey}
+		if err := db.QueryRow(`SELECT url FROM feeds WHERE publickey=?`, profile.PubKey).Scan(&entry.Url); err != nil {
+			continue
+		}
+		entry.NPubKey, _ = nip19.EncodePublicKey(entry.PubKey)
+		items = append(items, entry)
+		found[entry.PubKey] = true
+	}
+
+	matches, err := events.Search(db, query, &nostr.Filter{Kinds: []int{nostr.KindTextNote, feed.KindArticle}, Limit: 50})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var itemEntries []ItemEntry
+	for _, evt := range matches {
+		itemEntries = append(itemEntries, searchItemEntry(evt))
+	}
+
 	data := PageData{
 		Count:         count,
 		FilteredCount: uint64(len(items)),
 		Entries:       items,
+		Query:         query,
+		Items:         itemEntries,
 	}
 
 	_ = t.ExecuteTemplate(w, "search.html.tmpl", data)
 }
 
-func HandleCreateFeed(w http.ResponseWriter, r *http.Request, db *sql.DB, secret *string, dsn *string) {
+// searchItemEntry summarises a note or article found by a search: articles
+// are shown by their title and notes by their first characters.
+func searchItemEntry(evt nostr.Event) ItemEntry {
+	entry := ItemEntry{CreatedAt: evt.CreatedAt, Text: evt.Content}
+	entry.NoteID, _ = nip19.EncodeNote(evt.ID)
+	entry.NPubKey, _ = nip19.EncodePublicKey(evt.PubKey)
+	if title := evt.Tags.GetFirst([]string{"title", ""}); title != nil && title.Value() != "" {
+		entry.Text = title.Value()
+	}
+	entry.Text = feed.Truncate(entry.Text, 280)
+	if link := evt.Tags.GetFirst([]string{"r", ""}); link != nil {
+		entry.Url = link.Value()
+	}
+	return entry
+}
+
+func HandleCreateFeed(w http.ResponseWriter, r *http.Request, db *sql.DB, keys feed.KeyStore, remotes *signer.Remotes, dsn *string) {
 	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
 	if mustRedirect {
 		return
 	}
 
-	entry := createFeedEntry(r, db, secret)
+	entry := createFeedEntry(r, db, keys, remotes)
 	_ = t.ExecuteTemplate(w, "created.html.tmpl", entry)
 }
 
+// HandleClaim lets publishers claim the profile of their feed: they start a
+// claim for their own public key, prove they control the feed and choose how
+// the feed is handed over to them.
+func HandleClaim(w http.ResponseWriter, r *http.Request, db *sql.DB, keys feed.KeyStore, dsn *string) {
+	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
+	if mustRedirect {
+		return
+	}
+
+	page := claimPage(r, db, keys)
+	_ = t.ExecuteTemplate(w, "claim.html.tmpl", page)
+}
+
 func HandleFavicon(w http.ResponseWriter, r *http.Request) {
 	mustRedirect := handleOtherRegion(w, r)
 	if mustRedirect {
@@ -151,9 +242,9 @@ func HandleFavicon(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(assets.Favicon)
 }
 
-func HandleApiFeed(w http.ResponseWriter, r *http.Request, db *sql.DB, secret *string, dsn *string) {
+func HandleApiFeed(w http.ResponseWriter, r *http.Request, db *sql.DB, keys feed.KeyStore, remotes *signer.Remotes, dsn *string) {
 	if r.Method == http.MethodGet || r.Method == http.MethodPost {
-		handleCreateFeedEntry(w, r, db, secret, dsn)
+		handleCreateFeedEntry(w, r, db, keys, remotes, dsn)
 	} else {
 		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
 	}
@@ -190,13 +281,23 @@ func HandleNip05(w http.ResponseWriter, r *http.Request, db *sql.DB, ownerPubKey
 	_, _ = w.Write(response)
 }
 
-func handleCreateFeedEntry(w http.ResponseWriter, r *http.Request, db *sql.DB, secret *string, dsn *string) {
+func HandleWebSubCallback(w http.ResponseWriter, r *http.Request, subscriber *websub.Subscriber, dsn *string) {
 	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
 	if mustRedirect {
 		return
 	}
 
-	entry := createFeedEntry(r, db, secret)
+	pubkey := strings.TrimPrefix(r.URL.Path, "/websub/")
+	subscriber.HandleCallback(w, r, pubkey)
+}
+
+func handleCreateFeedEntry(w http.ResponseWriter, r *http.Request, db *sql.DB, keys feed.KeyStore, remotes *signer.Remotes, dsn *string) {
+	mustRedirect := handleRedirectToPrimaryNode(w, dsn)
+	if mustRedirect {
+		return
+	}
+
+	entry := createFeedEntry(r, db, keys, remotes)
 	w.Header().Set("Content-Type", "application/json")
 
 	if entry.ErrorCode >= 400 {
@@ -236,11 +337,79 @@ func handleRedirectToPrimaryNode(w http.ResponseWriter, dsn *string) bool {
 	return false
 }
 
-func createFeedEntry(r *http.Request, db *sql.DB, secret *string) *Entry {
-	urlParam := r.URL.Query().Get("url")
+func createFeedEntry(r *http.Request, db *sql.DB, keys feed.KeyStore, remotes *signer.Remotes) *Entry {
+	urlParam := r.FormValue("url")
 	entry := Entry{
 		Error: false,
 	}
+	articles, err := feed.ParseArticleMode(r.FormValue("articles"))
+	if err != nil {
+		entry.ErrorCode = http.StatusBadRequest
+		entry.Error = true
+		entry.ErrorMessage = "Bad options: " + err.Error()
+		return &entry
+	}
+
+	edits, err := feed.ParseEditPolicy(r.FormValue("edits"))
+	if err != nil {
+		entry.ErrorCode = http.StatusBadRequest
+		entry.Error = true
+		entry.ErrorMessage = "Bad options: " + err.Error()
+		return &entry
+	}
+
+	maxNoteLength := 0
+	if lengthParam := r.FormValue("note_length"); lengthParam != "" {
+		if maxNoteLength, err = strconv.Atoi(lengthParam); err != nil || maxNoteLength <= 0 {
+			entry.ErrorCode = http.StatusBadRequest
+			entry.Error = true
+			entry.ErrorMessage = "Bad options: note length must be a positive number"
+			return &entry
+		}
+	}
+
+	var maxHashtags *int
+	if hashtagsParam := r.FormValue("hashtags"); hashtagsParam != "" {
+		hashtags, err := strconv.Atoi(hashtagsParam)
+		if err != nil || hashtags < 0 {
+			entry.ErrorCode = http.StatusBadRequest
+			entry.Error = true
+			entry.ErrorMessage = "Bad options: hashtags must be zero or a positive number"
+			return &entry
+		}
+		maxHashtags = &hashtags
+	}
+
+	var ttl time.Duration
+	if ttlParam := r.FormValue("ttl"); ttlParam != "" {
+		if ttl, err = time.ParseDuration(ttlParam); err != nil || ttl < time.Second {
+			entry.ErrorCode = http.StatusBadRequest
+			entry.Error = true
+			entry.ErrorMessage = "Bad options: ttl must be a duration like 48h"
+			return &entry
+		}
+	}
+
+	deleteMissingItems := false
+	if deleteParam := r.FormValue("delete_missing"); deleteParam == "on" {
+		deleteMissingItems = true
+	} else if deleteParam != "" {
+		if deleteMissingItems, err = strconv.ParseBool(deleteParam); err != nil {
+			entry.ErrorCode = http.StatusBadRequest
+			entry.Error = true
+			entry.ErrorMessage = "Bad options: delete_missing must be true or false"
+			return &entry
+		}
+	}
+
+	keySource, err := feed.ParseKeySource(r.FormValue("key"))
+	if err != nil {
+		entry.ErrorCode = http.StatusBadRequest
+		entry.Error = true
+		entry.ErrorMessage = "Bad options: " + err.Error()
+		return &entry
+	}
+
 	feedUrl := feed.GetFeedURL(urlParam)
 	if feedUrl == "" {
 		entry.ErrorCode = http.StatusBadRequest
@@ -256,34 +425,170 @@ func createFeedEntry(r *http.Request, db *sql.DB, secret *string) *Entry {
 		return &entry
 	}
 
-	sk := feed.PrivateKeyFromFeed(feedUrl, *secret)
-	publicKey, err := nostr.GetPublicKey(sk)
-	if err != nil {
+	entry.Url = feedUrl
+
+	// Existing feeds keep the key they were created with, even if the secret
+	// has changed since then
+	var publicKey string
+	err = db.QueryRow(`SELECT publickey FROM feeds WHERE url=? ORDER BY key_version DESC LIMIT 1`, feedUrl).Scan(&publicKey)
+	if err == nil && keySource != feed.KeyDerived {
+		// Existing feeds are handed over to the keys of their owners by claiming them
+		entry.ErrorCode = http.StatusConflict
+		entry.Error = true
+		entry.ErrorMessage = "This feed already has a profile, claim it instead"
+		entry.PubKey = publicKey
+		entry.NPubKey, _ = nip19.EncodePublicKey(publicKey)
+		return &entry
+	} else if err == nil {
+		log.Printf("found feed at url %q as publicKey %s", feedUrl, publicKey)
+		entry.PubKey = publicKey
+		entry.NPubKey, _ = nip19.EncodePublicKey(publicKey)
+		return &entry
+	} else if err != sql.ErrNoRows {
 		entry.ErrorCode = http.StatusInternalServerError
 		entry.Error = true
-		entry.ErrorMessage = "bad private key: " + err.Error()
+		entry.ErrorMessage = "failed to retrieve feed: " + err.Error()
 		return &entry
 	}
 
-	publicKey = strings.TrimSpace(publicKey)
-	defer insertFeed(err, feedUrl, publicKey, sk, db)
+	var key feedKey
+	if keySource == feed.KeyDerived {
+		key, err = derivedKey(r.Context(), feedUrl, keys)
+		if err != nil {
+			entry.ErrorCode = http.StatusInternalServerError
+			entry.Error = true
+			entry.ErrorMessage = "bad private key: " + err.Error()
+			return &entry
+		}
+	} else if key, err = ownedKey(r, feedUrl, keySource, keys, remotes, db); errors.Is(err, feed.ErrKeyInUse) {
+		entry.ErrorCode = http.StatusConflict
+		entry.Error = true
+		entry.ErrorMessage = err.Error()
+		return &entry
+	} else if errors.Is(err, feed.ErrProofNotFound) {
+		entry.ErrorCode = http.StatusForbidden
+		entry.Error = true
+		entry.ErrorMessage = fmt.Sprintf("To publish this feed under your key, prove you control it: add %s to the title, description or copyright of the feed, or to %s, then try again",
+			feed.OwnerProof(key.PublicKey), feed.WellKnownURL(feedUrl))
+		return &entry
+	} else if err != nil {
+		entry.ErrorCode = http.StatusBadRequest
+		entry.Error = true
+		entry.ErrorMessage = "Bad key: " + err.Error()
+		return &entry
+	}
 
-	entry.Url = feedUrl
-	entry.PubKey = publicKey
-	entry.NPubKey, _ = nip19.EncodePublicKey(publicKey)
+	defer insertFeed(err, feedUrl, key, feed.Options{Articles: articles, MaxNoteLength: maxNoteLength, MaxHashtags: maxHashtags, Edits: edits, TTL: ttl, DeleteMissingItems: deleteMissingItems}, db)
+
+	entry.PubKey = key.PublicKey
+	entry.NPubKey, _ = nip19.EncodePublicKey(key.PublicKey)
 	return &entry
 }
 
-func insertFeed(err error, feedUrl string, publicKey string, sk string, db *sql.DB) {
+// feedKey is the key a new feed is created with, derived from the secret or
+// brought by the owner of the feed.
+type feedKey struct {
+	PublicKey string
+	// PrivateKey is the private key as it must be stored, empty for keys held
+	// by a bunker.
+	PrivateKey string
+	// Version is the version of the secret derived keys come from.
+	Version int
+	Source  feed.KeySource
+	// Bunker is the connection URL of the bunker holding remote keys.
+	Bunker string
+}
+
+// derivedKey derives the key of a new feed with the current secret.
+func derivedKey(ctx context.Context, feedUrl string, keys feed.KeyStore) (feedKey, error) {
+	stored, err := keys.Derive(ctx, feedUrl)
+	if err != nil {
+		return feedKey{}, err
+	}
+	return feedKey{PublicKey: stored.PublicKey, PrivateKey: stored.PrivateKey, Version: stored.Version, Source: feed.KeyDerived}, nil
+}
+
+// ownedKey returns the key the owner of a new feed brings, checking that they
+// hold it so nobody can publish under the key of someone else: an uploaded
+// private key proves it by itself, and a bunker must sign for the public key.
+// The feed must also have the owner proof of the key, so nobody can take the
+// profile of a feed they don't control.
+func ownedKey(r *http.Request, feedUrl string, source feed.KeySource, keys feed.KeyStore, remotes *signer.Remotes, db *sql.DB) (feedKey, error) {
+	key := feedKey{Source: source}
+	var remote *signer.Remote
+	switch source {
+	case feed.KeyUploaded:
+		// Private keys would be logged along with the URLs of requests
+		if r.Method != http.MethodPost || r.URL.Query().Has("private_key") {
+			return key, errors.New("private keys must be sent in the body of a POST request")
+		}
+		sk, err := parsePrivateKey(r.PostFormValue("private_key"))
+		if err != nil {
+			return key, err
+		}
+		stored, err := keys.Seal(r.Context(), sk)
+		if err != nil {
+			return key, err
+		}
+		key.PublicKey, key.PrivateKey = stored.PublicKey, stored.PrivateKey
+	case feed.KeyRemote:
+		var err error
+		key.Bunker = strings.TrimSpace(r.FormValue("bunker"))
+		if remote, err = remotes.Get(key.Bunker); err != nil {
+			return key, err
+		}
+		key.PublicKey = remote.BunkerPublicKey
+		if pubkeyParam := r.FormValue("pubkey"); pubkeyParam != "" {
+			if key.PublicKey, err = parsePublicKey(pubkeyParam); err != nil {
+				return key, err
+			}
+		}
+	}
+
+	if inUse, err := feed.KeyInUse(key.PublicKey, db); err != nil {
+		return key, err
+	} else if inUse {
+		return key, feed.ErrKeyInUse
+	}
+	if !feed.HasProof(feedUrl, feed.OwnerProof(key.PublicKey)) {
+		return key, feed.ErrProofNotFound
+	}
+
+	if remote != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		err := remote.Connect(ctx)
+		if err == nil {
+			err = signer.Prove(ctx, remote, key.PublicKey, "https://"+r.Host+r.URL.Path)
+		}
+		if err != nil {
+			remotes.Forget(key.Bunker)
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+// insertFeed stores a new feed with the given key and options. The options of
+// feeds that already exist are not changed, as anyone can submit the same url.
+// Feeds created with the key of their owner are already owned by it, so they
+// can't be claimed.
+func insertFeed(err error, feedUrl string, key feedKey, options feed.Options, db *sql.DB) {
+	publicKey := key.PublicKey
 	row := db.QueryRow("SELECT privatekey, url FROM feeds WHERE publickey=$1", publicKey)
 
 	var entity feed.Entity
 	err = row.Scan(&entity.PrivateKey, &entity.URL)
 	if err != nil && err == sql.ErrNoRows {
 		log.Printf("not found feed at url %q as publicKey %s", feedUrl, publicKey)
-		if _, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url) VALUES (?, ?, ?)`, publicKey, sk, feedUrl); err != nil {
+		owner := ""
+		if key.Source != feed.KeyDerived {
+			owner = publicKey
+		}
+		if _, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_version, key_source, bunker, owner) VALUES (?, ?, ?, ?, ?, ?, ?)`, publicKey, key.PrivateKey, feedUrl, key.Version, key.Source, key.Bunker, owner); err != nil {
 			log.Printf("failure: " + err.Error())
 		} else {
+			feed.SaveOptions(feedUrl, options, db)
 			log.Printf("saved feed at url %q as publicKey %s", feedUrl, publicKey)
 		}
 	} else if err != nil {
@@ -292,3 +597,113 @@ func insertFeed(err error, feedUrl string, publicKey string, sk string, db *sql.
 		log.Printf("found feed at url %q as publicKey %s", feedUrl, publicKey)
 	}
 }
+
+func claimPage(r *http.Request, db *sql.DB, keys feed.KeyStore) *ClaimPage {
+	page := ClaimPage{}
+	fail := func(message string) *ClaimPage {
+		page.Error = true
+		page.ErrorMessage = message
+		return &page
+	}
+
+	now := time.Now()
+	token := r.FormValue("token")
+	if token == "" {
+		pubkey, err := parsePublicKey(r.FormValue("pubkey"))
+		if err != nil {
+			return fail("Unknown feed: " + err.Error())
+		}
+		page.PubKey = pubkey
+		page.NPubKey, _ = nip19.EncodePublicKey(pubkey)
+		if r.Method != http.MethodPost {
+			return &page
+		}
+
+		owner, err := parsePublicKey(r.FormValue("owner"))
+		if err != nil {
+			return fail("Bad owner: " + err.Error())
+		}
+		claim, err := feed.StartClaim(pubkey, owner, now, db)
+		if err != nil {
+			return fail("Could not start the claim: " + err.Error())
+		}
+		token = claim.Token
+	}
+
+	claim, err := feed.GetClaim(token, db)
+	if err != nil {
+		return fail(err.Error())
+	}
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "verify":
+			_, err = feed.VerifyClaim(claim, now, db)
+		case "export":
+			err = exportKey(r, claim, keys, now, db)
+		case "delegate":
+			err = feed.CompleteClaim(claim, feed.HandoverDelegation, strings.TrimSpace(r.FormValue("sig")), now, db)
+		}
+		if err != nil {
+			page.Error = true
+			page.ErrorMessage = err.Error()
+		}
+		if claim, err = feed.GetClaim(token, db); err != nil {
+			return fail(err.Error())
+		}
+	}
+
+	page.Claim = claim
+	page.PubKey = claim.PublicKey
+	page.NPubKey, _ = nip19.EncodePublicKey(claim.PublicKey)
+	page.OwnerNPubKey, _ = nip19.EncodePublicKey(claim.Owner)
+	page.WellKnownUrl = feed.WellKnownURL(claim.URL)
+	return &page
+}
+
+// exportKey hands a claimed feed over by sending its private key to the owner
+// as an encrypted direct message from the feed, served by this relay.
+func exportKey(r *http.Request, claim feed.Claim, keys feed.KeyStore, now time.Time, db *sql.DB) error {
+	message, err := keys.Export(r.Context(), claim.Token)
+	if err != nil {
+		return err
+	}
+	if message.PubKey != claim.PublicKey {
+		return errors.New("the key export is not from the claimed feed")
+	}
+	// The message is stored first, so no claim is completed without it
+	if _, err := events.Save(db, message, ""); err != nil {
+		return err
+	}
+	return feed.CompleteClaim(claim, feed.HandoverExport, "", now, db)
+}
+
+// parsePrivateKey accepts private keys in hex or as nsec.
+func parsePrivateKey(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "nsec") {
+		if _, decoded, err := nip19.Decode(value); err == nil {
+			value, _ = decoded.(string)
+		}
+	}
+	if key, err := hex.DecodeString(value); err != nil || len(key) != 32 {
+		return "", errors.New("expected a private key in hex or nsec")
+	}
+	if _, err := nostr.GetPublicKey(value); err != nil {
+		return "", errors.New("invalid private key")
+	}
+	return value, nil
+}
+
+// parsePublicKey accepts public keys in hex or as npub.
+func parsePublicKey(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "npub") {
+		if _, decoded, err := nip19.Decode(value); err == nil {
+			value, _ = decoded.(string)
+		}
+	}
+	if key, err := hex.DecodeString(value); err != nil || len(key) != 32 {
+		return "", errors.New("expected a public key in hex or npub")
+	}
+	return value, nil
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFeedsAreCreatedWithOwnedKeysOnlyWithTheOwnerProof(t *testing.T) {
+	db := testdb.Open(t)
+	keyring, _ := feed.NewKeyring("secret", 1, nil)
+	keys := &feed.LocalKeys{Keyring: &keyring, DB: db}
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+
+	description := "My blog"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>Blog</title><description>` + description + `</description>` +
+			`<item><title>Comment</title><description>` + feed.OwnerProof(pk) + `</description></item></channel></rss>`))
+	}))
+	defer server.Close()
+
+	create := func() *Entry {
+		form := url.Values{"url": {server.URL + "/feed.xml"}, "key": {"uploaded"}, "private_key": {sk}}
+		req := httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return createFeedEntry(req, db, keys, nil)
+	}
+
+	// A proof in an item doesn't show control of the feed
+	entry := create()
+	assert.True(t, entry.Error)
+	assert.Equal(t, http.StatusForbidden, entry.ErrorCode)
+	assert.Contains(t, entry.ErrorMessage, feed.OwnerProof(pk))
+	inUse, _ := feed.KeyInUse(pk, db)
+	assert.False(t, inUse)
+
+	description = "My blog " + feed.OwnerProof(pk)
+	entry = create()
+	assert.False(t, entry.Error, entry.ErrorMessage)
+	assert.Equal(t, pk, entry.PubKey)
+	inUse, _ = feed.KeyInUse(pk, db)
+	assert.True(t, inUse)
+}
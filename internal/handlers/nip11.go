@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"net/http"
+	"strings"
+)
+
+// RelayInformationDocument is the NIP-11 document of the relay, with the
+// limitation fields missing from the go-nostr one.
+type RelayInformationDocument struct {
+	nip11.RelayInformationDocument
+	Limitation *RelayLimitation `json:"limitation,omitempty"`
+}
+
+// RelayLimitation are the limits the relay applies to clients.
+type RelayLimitation struct {
+	MaxMessageLength int  `json:"max_message_length,omitempty"`
+	MaxSubscriptions int  `json:"max_subscriptions,omitempty"`
+	MaxFilters       int  `json:"max_filters,omitempty"`
+	MaxLimit         int  `json:"max_limit,omitempty"`
+	MaxSubidLength   int  `json:"max_subid_length,omitempty"`
+	MaxEventTags     int  `json:"max_event_tags,omitempty"`
+	MaxContentLength int  `json:"max_content_length,omitempty"`
+	MinPowDifficulty int  `json:"min_pow_difficulty,omitempty"`
+	AuthRequired     bool `json:"auth_required"`
+	PaymentRequired  bool `json:"payment_required"`
+	RestrictedWrites bool `json:"restricted_writes"`
+}
+
+// Nip11Middleware answers the requests to the root asking for the NIP-11
+// document with the given one, instead of the default document of relayer.
+func Nip11Middleware(document *RelayInformationDocument) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" || !strings.Contains(r.Header.Get("Accept"), "application/nostr+json") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/nostr+json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Headers", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			_ = json.NewEncoder(w).Encode(document)
+		})
+	}
+}
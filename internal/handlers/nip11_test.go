@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNip11MiddlewareServesTheDocumentToNostrClients(t *testing.T) {
+	document := &RelayInformationDocument{
+		RelayInformationDocument: nip11.RelayInformationDocument{
+			Name:          "My rsslay",
+			SupportedNIPs: []int{11, 50},
+		},
+		Limitation: &RelayLimitation{MaxLimit: 500, RestrictedWrites: true},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("webpage"))
+	})
+	handler := Nip11Middleware(document)(next)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, "application/nostr+json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	var served map[string]any
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served))
+	assert.Equal(t, "My rsslay", served["name"])
+	assert.Equal(t, []any{11.0, 50.0}, served["supported_nips"])
+	assert.Equal(t, map[string]any{"max_limit": 500.0, "auth_required": false, "payment_required": false, "restricted_writes": true}, served["limitation"])
+
+	// Browsers and other paths get the webpage
+	for _, path := range []string{"/", "/search"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if path != "/" {
+			req.Header.Set("Accept", "application/nostr+json")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, "webpage", rec.Body.String(), path)
+	}
+}
@@ -0,0 +1,26 @@
+// Package testdb provides the database used by tests.
+package testdb
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/piraces/rsslay/scripts"
+	"testing"
+)
+
+// Open returns an empty in-memory database with the schema migrated, closed
+// when the test ends.
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a test database", err)
+	}
+	// Every connection to :memory: would get its own database
+	db.SetMaxOpenConns(1)
+	if err := scripts.Migrate(db); err != nil {
+		t.Fatalf("an error '%s' was not expected when migrating the test database", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
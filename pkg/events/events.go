@@ -0,0 +1,347 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Save stores a signed event produced from a feed, along with the key of the
+// item it was converted from, usually its GUID (empty for profile metadata).
+// It returns true if the event was not stored before.
+func Save(db *sql.DB, evt nostr.Event, guid string) (bool, error) {
+	tags, err := json.Marshal(evt.Tags)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal tags of event %s: %w", evt.ID, err)
+	}
+
+	// Events already expired are not worth storing
+	var expiresAt int64
+	if expiration, ok := ExpiresAt(evt); ok {
+		if !expiration.After(time.Now()) {
+			return false, nil
+		}
+		expiresAt = expiration.Unix()
+	}
+
+	res, err := db.Exec(`INSERT OR IGNORE INTO events (id, pubkey, kind, created_at, tags, content, sig, guid, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		evt.ID, evt.PubKey, evt.Kind, evt.CreatedAt.Unix(), string(tags), evt.Content, evt.Sig, guid, expiresAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to save event %s: %w", evt.ID, err)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	// Metadata is replaceable, so only the latest one for each pubkey is kept
+	if inserted > 0 && evt.Kind == nostr.KindSetMetadata {
+		if _, err := db.Exec(`DELETE FROM events WHERE pubkey=? AND kind=? AND id<>?`, evt.PubKey, evt.Kind, evt.ID); err != nil {
+			return true, fmt.Errorf("failed to replace metadata of %s: %w", evt.PubKey, err)
+		}
+	}
+
+	// Parameterized replaceable events only keep the latest one for each "d" tag
+	if inserted > 0 && evt.Kind >= 30000 && evt.Kind < 40000 {
+		return replaceParameterized(db, evt)
+	}
+
+	return inserted > 0, nil
+}
+
+// ExpiresAt returns when the event expires according to its NIP-40 expiration
+// tag, if it has one.
+func ExpiresAt(evt nostr.Event) (time.Time, bool) {
+	tag := evt.Tags.GetFirst([]string{"expiration", ""})
+	if tag == nil {
+		return time.Time{}, false
+	}
+	expiration, err := strconv.ParseInt(tag.Value(), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(expiration, 0), true
+}
+
+// DeleteExpired removes the stored events that expired before now, returning
+// how many were removed.
+func DeleteExpired(db *sql.DB, now time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM events WHERE expires_at > 0 AND expires_at <= ?`, now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired events: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// dTag returns the SQL expression of the value of the first "d" tag of the
+// events in the given table.
+func dTag(table string) string {
+	return `IFNULL((SELECT json_extract(value, '$[1]') FROM json_each(` + table + `.tags) WHERE json_extract(value, '$[0]')='d' LIMIT 1), '')`
+}
+
+func replaceParameterized(db *sql.DB, evt nostr.Event) (bool, error) {
+	identifier := ""
+	if d := evt.Tags.GetFirst([]string{"d", ""}); d != nil {
+		identifier = d.Value()
+	}
+
+	if _, err := db.Exec(fmt.Sprintf(`DELETE FROM events WHERE pubkey=? AND kind=? AND id<>? AND created_at<=? AND %s=?`, dTag("events")),
+		evt.PubKey, evt.Kind, evt.ID, evt.CreatedAt.Unix(), identifier); err != nil {
+		return true, fmt.Errorf("failed to replace event %s: %w", evt.ID, err)
+	}
+
+	// An older version of an event arriving late doesn't replace the newer one
+	res, err := db.Exec(fmt.Sprintf(`DELETE FROM events WHERE id=? AND EXISTS (SELECT 1 FROM events AS newer WHERE newer.pubkey=? AND newer.kind=? AND newer.created_at>? AND %s=?)`, dTag("newer")),
+		evt.ID, evt.PubKey, evt.Kind, evt.CreatedAt.Unix(), identifier)
+	if err != nil {
+		return true, fmt.Errorf("failed to replace event %s: %w", evt.ID, err)
+	}
+	stale, err := res.RowsAffected()
+	return stale == 0, err
+}
+
+// ForItem returns the stored events converted from the item with the given key
+// of the feed with the given public key.
+func ForItem(db *sql.DB, pubkey string, guid string) ([]nostr.Event, error) {
+	rows, err := db.Query(`SELECT id, pubkey, kind, created_at, tags, content, sig FROM events WHERE pubkey=? AND guid=? ORDER BY created_at DESC, id`, pubkey, guid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events of item %q: %w", guid, err)
+	}
+	return scanEvents(rows)
+}
+
+// ApplyDeletion removes the stored events referenced by a NIP-09 deletion, by
+// id or by address, as long as they belong to the author of the deletion.
+func ApplyDeletion(db *sql.DB, deletion nostr.Event) error {
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			if _, err := db.Exec(`DELETE FROM events WHERE id=? AND pubkey=?`, tag[1], deletion.PubKey); err != nil {
+				return fmt.Errorf("failed to delete event %s: %w", tag[1], err)
+			}
+		case "a":
+			parts := strings.SplitN(tag[1], ":", 3)
+			if len(parts) != 3 || parts[1] != deletion.PubKey {
+				continue
+			}
+			if _, err := db.Exec(fmt.Sprintf(`DELETE FROM events WHERE kind=? AND pubkey=? AND created_at<=? AND %s=?`, dTag("events")),
+				parts[0], deletion.PubKey, deletion.CreatedAt.Unix(), parts[2]); err != nil {
+				return fmt.Errorf("failed to delete event %s: %w", tag[1], err)
+			}
+		}
+	}
+	return nil
+}
+
+// Query returns the stored events matching the filter, newest first and capped
+// to the filter limit if any.
+func Query(db *sql.DB, filter *nostr.Filter) ([]nostr.Event, error) {
+	return query(db, filter, "")
+}
+
+// Search returns the stored events matching the filter whose text contains all
+// the terms of the search query, newest first. The text of profiles is
+// their name and about, the one of notes and articles their title, summary,
+// hashtags and content. Terms are matched as whole words, and "key:value"
+// terms are ignored.
+//
+// Only the web search page uses it: NIP-50 searches from relay clients are not
+// answered, as the pinned relayer drops the search field of REQ filters.
+func Search(db *sql.DB, search string, filter *nostr.Filter) ([]nostr.Event, error) {
+	match := matchQuery(search)
+	if match == "" {
+		return nil, nil
+	}
+	return query(db, filter, match)
+}
+
+// prefixCondition matches a column against hex values, either whole or as
+// prefixes, returning an empty condition if no value is valid.
+func prefixCondition(column string, values []string) (string, []any) {
+	var matches []string
+	var params []any
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if !isHex(value) {
+			continue
+		}
+		if len(value) == 64 {
+			matches = append(matches, column+" = ?")
+			params = append(params, value)
+		} else {
+			matches = append(matches, column+" LIKE ?")
+			params = append(params, value+"%")
+		}
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(matches, " OR ") + ")", params
+}
+
+// where returns the conditions and parameters selecting the events matching a
+// filter and full-text query, and false if no event can match it.
+func where(filter *nostr.Filter, match string) (string, []any, bool) {
+	// Expired events are no longer served, even before they are deleted
+	conditions := []string{"(expires_at = 0 OR expires_at > ?)"}
+	params := []any{time.Now().Unix()}
+
+	if match != "" {
+		conditions = append(conditions, "id IN (SELECT id FROM events_search_ids WHERE docid IN (SELECT docid FROM events_search WHERE text MATCH ?))")
+		params = append(params, match)
+	}
+
+	// Prefixes of ids and authors are accepted as well, like live subscriptions do
+	if filter.IDs != nil {
+		condition, values := prefixCondition("id", filter.IDs)
+		if condition == "" {
+			return "", nil, false
+		}
+		conditions = append(conditions, condition)
+		params = append(params, values...)
+	}
+
+	if filter.Authors != nil {
+		condition, values := prefixCondition("pubkey", filter.Authors)
+		if condition == "" {
+			return "", nil, false
+		}
+		conditions = append(conditions, condition)
+		params = append(params, values...)
+	}
+
+	if filter.Kinds != nil {
+		if len(filter.Kinds) == 0 {
+			return "", nil, false
+		}
+		conditions = append(conditions, "kind IN ("+placeholders(len(filter.Kinds))+")")
+		for _, kind := range filter.Kinds {
+			params = append(params, kind)
+		}
+	}
+
+	for name, values := range filter.Tags {
+		if len(values) == 0 {
+			return "", nil, false
+		}
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM json_each(events.tags) WHERE json_extract(value, '$[0]') = ? AND json_extract(value, '$[1]') IN (`+placeholders(len(values))+`))`)
+		params = append(params, name)
+		for _, value := range values {
+			params = append(params, value)
+		}
+	}
+
+	if filter.Since != nil {
+		conditions = append(conditions, "created_at >= ?")
+		params = append(params, filter.Since.Unix())
+	}
+
+	if filter.Until != nil {
+		conditions = append(conditions, "created_at <= ?")
+		params = append(params, filter.Until.Unix())
+	}
+
+	return strings.Join(conditions, " AND "), params, true
+}
+
+// Count returns the number of stored events matching any of the filters,
+// ignoring their limits, to answer NIP-45 COUNT requests.
+func Count(db *sql.DB, filters nostr.Filters) (int64, error) {
+	var conditions []string
+	var params []any
+	for i := range filters {
+		condition, filterParams, ok := where(&filters[i], "")
+		if !ok {
+			continue
+		}
+		conditions = append(conditions, "("+condition+")")
+		params = append(params, filterParams...)
+	}
+	if len(conditions) == 0 {
+		return 0, nil
+	}
+
+	var count int64
+	if err := db.QueryRow(`SELECT count(*) FROM events WHERE `+strings.Join(conditions, " OR "), params...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count events: %w", err)
+	}
+	return count, nil
+}
+
+func query(db *sql.DB, filter *nostr.Filter, match string) ([]nostr.Event, error) {
+	conditions, params, ok := where(filter, match)
+	if !ok {
+		return nil, nil
+	}
+
+	statement := `SELECT id, pubkey, kind, created_at, tags, content, sig FROM events WHERE ` + conditions + " ORDER BY created_at DESC, id"
+	if filter.Limit > 0 {
+		statement += " LIMIT ?"
+		params = append(params, filter.Limit)
+	}
+
+	rows, err := db.Query(statement, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	return scanEvents(rows)
+}
+
+func scanEvents(rows *sql.Rows) ([]nostr.Event, error) {
+	defer rows.Close()
+
+	var events []nostr.Event
+	for rows.Next() {
+		var evt nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&evt.ID, &evt.PubKey, &evt.Kind, &createdAt, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+			return nil, fmt.Errorf("failed to scan event: %w", err)
+		}
+		evt.CreatedAt = time.Unix(createdAt, 0)
+		events = append(events, evt)
+	}
+
+	return events, rows.Err()
+}
+
+// matchQuery converts a search query into a full-text query matching every
+// term, quoting them so the query syntax can't be misused.
+func matchQuery(search string) string {
+	var terms []string
+	for _, term := range strings.Fields(search) {
+		if strings.Contains(term, ":") {
+			continue
+		}
+		term = strings.ReplaceAll(term, `"`, "")
+		if strings.IndexFunc(term, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) < 0 {
+			continue
+		}
+		terms = append(terms, `"`+term+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func isHex(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
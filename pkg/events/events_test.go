@@ -0,0 +1,384 @@
+package events
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const samplePrivateKey = "27660ab89e69f59bb8d9f0bd60da4a8515cdd3e2ca4f91d72a242b086d6aaaa7"
+const samplePubKey = "1870bcd5f6081ef7ea4b17204ffa4e92de51670142be0c8140e0635b355ca85f"
+
+func sampleEvent(t *testing.T, kind int, createdAt int64, content string) nostr.Event {
+	evt := nostr.Event{
+		PubKey:    samplePubKey,
+		CreatedAt: time.Unix(createdAt, 0),
+		Kind:      kind,
+		Tags:      nostr.Tags{},
+		Content:   content,
+	}
+	if err := evt.Sign(samplePrivateKey); err != nil {
+		t.Fatalf("an error '%s' was not expected when signing a sample event", err)
+	}
+	return evt
+}
+
+func TestSaveReturnsTrueOnlyForNewEvents(t *testing.T) {
+	db := testdb.Open(t)
+	evt := sampleEvent(t, nostr.KindTextNote, 1000, "first")
+
+	inserted, err := Save(db, evt, "guid-1")
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+
+	inserted, err = Save(db, evt, "guid-1")
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+}
+
+func TestSaveReplacesMetadata(t *testing.T) {
+	db := testdb.Open(t)
+	_, _ = Save(db, sampleEvent(t, nostr.KindSetMetadata, 1000, `{"name":"old"}`), "")
+	_, _ = Save(db, sampleEvent(t, nostr.KindSetMetadata, 2000, `{"name":"new"}`), "")
+
+	stored, err := Query(db, &nostr.Filter{Kinds: []int{nostr.KindSetMetadata}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, `{"name":"new"}`, stored[0].Content)
+}
+
+func TestQueryAppliesFilterNewestFirst(t *testing.T) {
+	db := testdb.Open(t)
+	for i, content := range []string{"a", "b", "c", "d"} {
+		_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, int64(1000*(i+1)), content), content)
+	}
+	_, _ = Save(db, sampleEvent(t, nostr.KindSetMetadata, 5000, "{}"), "")
+
+	since := time.Unix(2000, 0)
+	until := time.Unix(4000, 0)
+	stored, err := Query(db, &nostr.Filter{
+		Authors: []string{samplePubKey},
+		Kinds:   []int{nostr.KindTextNote},
+		Since:   &since,
+		Until:   &until,
+		Limit:   2,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 2)
+	assert.Equal(t, "d", stored[0].Content)
+	assert.Equal(t, "c", stored[1].Content)
+
+	ok, err := stored[0].CheckSignature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestQueryWithUnknownAuthorReturnsNothing(t *testing.T) {
+	db := testdb.Open(t)
+	_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, 1000, "a"), "a")
+
+	stored, err := Query(db, &nostr.Filter{Authors: []string{"unknown"}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestQueryMatchesPrefixesOfAuthorsLikeSubscriptions(t *testing.T) {
+	db := testdb.Open(t)
+	evt := sampleEvent(t, nostr.KindTextNote, 1000, "a")
+	_, _ = Save(db, evt, "a")
+
+	for _, authors := range [][]string{{samplePubKey[:8]}, {"ffff", samplePubKey}} {
+		filter := &nostr.Filter{Authors: authors}
+		stored, err := Query(db, filter)
+		assert.NoError(t, err)
+		assert.Len(t, stored, 1, authors)
+		assert.True(t, filter.Matches(&evt), authors)
+	}
+	stored, err := Query(db, &nostr.Filter{Authors: []string{samplePubKey[1:9]}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestSaveReplacesArticlesWithTheSameIdentifier(t *testing.T) {
+	db := testdb.Open(t)
+	article := func(createdAt int64, identifier string, content string) nostr.Event {
+		evt := nostr.Event{
+			PubKey:    samplePubKey,
+			CreatedAt: time.Unix(createdAt, 0),
+			Kind:      30023,
+			Tags:      nostr.Tags{{"d", identifier}},
+			Content:   content,
+		}
+		_ = evt.Sign(samplePrivateKey)
+		return evt
+	}
+
+	_, _ = Save(db, article(1000, "a", "first version"), "a")
+	_, _ = Save(db, article(1000, "b", "other article"), "b")
+	inserted, err := Save(db, article(2000, "a", "second version"), "a")
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+
+	// Older versions arriving late are discarded
+	inserted, err = Save(db, article(1500, "a", "stale version"), "a")
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+
+	stored, err := Query(db, &nostr.Filter{Kinds: []int{30023}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 2)
+	assert.Equal(t, "second version", stored[0].Content)
+	assert.Equal(t, "other article", stored[1].Content)
+}
+
+func TestQueryByIDs(t *testing.T) {
+	db := testdb.Open(t)
+	first := sampleEvent(t, nostr.KindTextNote, 1000, "first")
+	second := sampleEvent(t, nostr.KindTextNote, 2000, "second")
+	_, _ = Save(db, first, "first")
+	_, _ = Save(db, second, "second")
+
+	stored, err := Query(db, &nostr.Filter{IDs: []string{first.ID}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, first.ID, stored[0].ID)
+
+	stored, err = Query(db, &nostr.Filter{IDs: []string{second.ID[:8], "not%hex"}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, second.ID, stored[0].ID)
+
+	stored, err = Query(db, &nostr.Filter{IDs: []string{"%"}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestQueryByTags(t *testing.T) {
+	db := testdb.Open(t)
+	tagged := func(createdAt int64, content string, tags nostr.Tags) nostr.Event {
+		evt := nostr.Event{
+			PubKey:    samplePubKey,
+			CreatedAt: time.Unix(createdAt, 0),
+			Kind:      nostr.KindTextNote,
+			Tags:      tags,
+			Content:   content,
+		}
+		_ = evt.Sign(samplePrivateKey)
+		return evt
+	}
+	_, _ = Save(db, tagged(1000, "go", nostr.Tags{{"t", "go"}, {"r", "https://blog.example/go"}}), "go")
+	_, _ = Save(db, tagged(2000, "nostr", nostr.Tags{{"t", "nostr"}}), "nostr")
+	_, _ = Save(db, tagged(3000, "both", nostr.Tags{{"t", "go"}, {"t", "nostr"}}), "both")
+
+	stored, err := Query(db, &nostr.Filter{Tags: nostr.TagMap{"t": {"nostr"}}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 2)
+	assert.Equal(t, "both", stored[0].Content)
+	assert.Equal(t, "nostr", stored[1].Content)
+
+	stored, err = Query(db, &nostr.Filter{Tags: nostr.TagMap{"t": {"go"}, "r": {"https://blog.example/go"}}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, "go", stored[0].Content)
+
+	stored, err = Query(db, &nostr.Filter{Tags: nostr.TagMap{"t": {"go", "nostr"}}, Limit: 1})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, "both", stored[0].Content)
+
+	stored, err = Query(db, &nostr.Filter{Tags: nostr.TagMap{"p": {samplePubKey}}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestQueryWithoutAuthorsReturnsRecentEventsOfAllFeeds(t *testing.T) {
+	db := testdb.Open(t)
+	otherPrivateKey := nostr.GeneratePrivateKey()
+	otherPubKey, _ := nostr.GetPublicKey(otherPrivateKey)
+	for i := int64(1); i <= 3; i++ {
+		_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, i*1000, "sample"), "")
+		other := nostr.Event{PubKey: otherPubKey, CreatedAt: time.Unix(i*1000+500, 0), Kind: nostr.KindTextNote, Tags: nostr.Tags{}, Content: "other"}
+		_ = other.Sign(otherPrivateKey)
+		_, _ = Save(db, other, "")
+	}
+
+	stored, err := Query(db, &nostr.Filter{Kinds: []int{nostr.KindTextNote}, Limit: 3})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 3)
+	assert.Equal(t, []int64{3500, 3000, 2500}, []int64{stored[0].CreatedAt.Unix(), stored[1].CreatedAt.Unix(), stored[2].CreatedAt.Unix()})
+}
+
+func TestSearchMatchesItemsAndProfiles(t *testing.T) {
+	db := testdb.Open(t)
+	_, _ = Save(db, sampleEvent(t, nostr.KindSetMetadata, 1000, `{"name":"Lightning News","about":"All about the network"}`), "")
+	_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, 2000, "Bitcoin reaches a new high"), "a")
+	_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, 3000, "Lightning payments, explained"), "b")
+
+	article := nostr.Event{
+		PubKey:    samplePubKey,
+		CreatedAt: time.Unix(4000, 0),
+		Kind:      30023,
+		Tags:      nostr.Tags{{"d", "c"}, {"title", "Café culture"}, {"t", "coffee"}},
+		Content:   "A long read",
+	}
+	_ = article.Sign(samplePrivateKey)
+	_, _ = Save(db, article, "c")
+
+	contents := func(search string, filter nostr.Filter) []string {
+		stored, err := Search(db, search, &filter)
+		assert.NoError(t, err)
+		var result []string
+		for _, evt := range stored {
+			result = append(result, evt.Content)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"Lightning payments, explained", `{"name":"Lightning News","about":"All about the network"}`}, contents("lightning", nostr.Filter{}))
+	assert.Equal(t, []string{"Lightning payments, explained"}, contents("lightning", nostr.Filter{Kinds: []int{nostr.KindTextNote}}))
+	assert.Equal(t, []string{"Bitcoin reaches a new high"}, contents("new BITCOIN", nostr.Filter{}))
+	assert.Equal(t, []string{"A long read"}, contents("café", nostr.Filter{}))
+	assert.Equal(t, []string{"A long read"}, contents("coffee language:en", nostr.Filter{}))
+	assert.Empty(t, contents("bitcoin lightning", nostr.Filter{}))
+	assert.Empty(t, contents(`"unbalanced OR *`, nostr.Filter{}))
+	assert.Empty(t, contents("language:en", nostr.Filter{}))
+
+	// Deleted events are no longer found
+	_, _ = Save(db, sampleEvent(t, nostr.KindSetMetadata, 5000, `{"name":"Renamed"}`), "")
+	assert.Equal(t, []string{"Lightning payments, explained"}, contents("lightning", nostr.Filter{}))
+}
+
+func TestSearchSurvivesRenumberedEvents(t *testing.T) {
+	db := testdb.Open(t)
+	for i, content := range []string{"first apple", "second banana", "third cherry"} {
+		_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, int64(1000+i), content), content)
+	}
+	_, err := db.Exec(`DELETE FROM events WHERE content='first apple'`)
+	assert.NoError(t, err)
+	// Rows of events may be renumbered, as VACUUM is allowed to, without moving
+	// search results
+	_, err = db.Exec(`UPDATE events SET rowid = rowid - 1`)
+	assert.NoError(t, err)
+
+	for search, content := range map[string]string{"banana": "second banana", "cherry": "third cherry"} {
+		stored, err := Search(db, search, &nostr.Filter{})
+		assert.NoError(t, err)
+		if assert.Len(t, stored, 1, search) {
+			assert.Equal(t, content, stored[0].Content)
+		}
+	}
+	stored, err := Search(db, "apple", &nostr.Filter{})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestCountIgnoresLimitsAndOverlappingFilters(t *testing.T) {
+	db := testdb.Open(t)
+	_, _ = Save(db, sampleEvent(t, nostr.KindSetMetadata, 1000, `{"name":"feed"}`), "")
+	for i, content := range []string{"a", "b", "c"} {
+		_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, int64(2000+i), content), content)
+	}
+
+	count, err := Count(db, nostr.Filters{{Authors: []string{samplePubKey}, Kinds: []int{nostr.KindTextNote}, Limit: 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+
+	count, err = Count(db, nostr.Filters{{Kinds: []int{nostr.KindTextNote}}, {Authors: []string{samplePubKey}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), count)
+
+	count, err = Count(db, nostr.Filters{{Authors: []string{}}, {Kinds: []int{nostr.KindSetMetadata}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = Count(db, nostr.Filters{{Authors: []string{}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestApplyDeletionRemovesReferencedEventsOfItsAuthor(t *testing.T) {
+	db := testdb.Open(t)
+	note := sampleEvent(t, nostr.KindTextNote, 1000, "note")
+	_, _ = Save(db, note, "item")
+	article := nostr.Event{
+		PubKey:    samplePubKey,
+		CreatedAt: time.Unix(1000, 0),
+		Kind:      30023,
+		Tags:      nostr.Tags{{"d", "item"}},
+		Content:   "article",
+	}
+	_ = article.Sign(samplePrivateKey)
+	_, _ = Save(db, article, "item")
+	other := sampleEvent(t, nostr.KindTextNote, 1000, "other")
+	_, _ = Save(db, other, "other")
+
+	published, err := ForItem(db, samplePubKey, "item")
+	assert.NoError(t, err)
+	assert.Len(t, published, 2)
+
+	// Deletions of events of other authors are ignored
+	foreign := nostr.Event{PubKey: "other", CreatedAt: time.Unix(2000, 0), Kind: nostr.KindDeletion, Tags: nostr.Tags{{"e", other.ID}}}
+	assert.NoError(t, ApplyDeletion(db, foreign))
+
+	deletion := nostr.Event{
+		PubKey:    samplePubKey,
+		CreatedAt: time.Unix(2000, 0),
+		Kind:      nostr.KindDeletion,
+		Tags:      nostr.Tags{{"e", note.ID}, {"a", "30023:" + samplePubKey + ":item"}},
+	}
+	assert.NoError(t, ApplyDeletion(db, deletion))
+
+	published, err = ForItem(db, samplePubKey, "item")
+	assert.NoError(t, err)
+	assert.Empty(t, published)
+	stored, err := Query(db, &nostr.Filter{Authors: []string{samplePubKey}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, other.ID, stored[0].ID)
+}
+
+func TestExpiredEventsAreNotStoredNorServed(t *testing.T) {
+	db := testdb.Open(t)
+	expiring := func(content string, expiration time.Time) nostr.Event {
+		evt := nostr.Event{
+			PubKey:    samplePubKey,
+			CreatedAt: time.Unix(1000, 0),
+			Kind:      nostr.KindTextNote,
+			Tags:      nostr.Tags{{"expiration", strconv.FormatInt(expiration.Unix(), 10)}},
+			Content:   content,
+		}
+		_ = evt.Sign(samplePrivateKey)
+		return evt
+	}
+
+	inserted, err := Save(db, expiring("expired", time.Now().Add(-time.Minute)), "expired")
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+
+	inserted, err = Save(db, expiring("expiring", time.Now().Add(time.Hour)), "expiring")
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	_, _ = Save(db, sampleEvent(t, nostr.KindTextNote, 1000, "permanent"), "permanent")
+
+	stored, err := Query(db, &nostr.Filter{Authors: []string{samplePubKey}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 2)
+
+	// Once expired, events are hidden until they are deleted
+	_, err = db.Exec(`UPDATE events SET expires_at=? WHERE content='expiring'`, time.Now().Add(-time.Second).Unix())
+	assert.NoError(t, err)
+	stored, err = Query(db, &nostr.Filter{Authors: []string{samplePubKey}})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, "permanent", stored[0].Content)
+	count, err := Count(db, nostr.Filters{{Authors: []string{samplePubKey}}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	deleted, err := DeleteExpired(db, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+}
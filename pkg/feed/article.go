@@ -0,0 +1,69 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KindArticle is the kind of NIP-23 long-form content events.
+const KindArticle = 30023
+
+// ItemToArticle converts an item into a NIP-23 long-form article with its full
+// content as Markdown. Articles are replaceable by the key of their item, so
+// updated items replace the previous version of the article.
+func ItemToArticle(pubkey string, item *gofeed.Item, defaultCreatedAt time.Time, settings Settings) nostr.Event {
+	body := item.Content
+	summary := ""
+	if body == "" {
+		body = item.Description
+	} else {
+		summary = HTMLToText(item.Description, item.Link)
+	}
+
+	tags := nostr.Tags{{"d", ItemKey(item)}}
+	if title := strings.TrimSpace(html.UnescapeString(item.Title)); title != "" {
+		tags = append(tags, nostr.Tag{"title", title})
+	}
+	if summary != "" {
+		tags = append(tags, nostr.Tag{"summary", summary})
+	}
+	media := ItemMedia(item)
+	for _, m := range media {
+		if m.IsImage() {
+			tags = append(tags, nostr.Tag{"image", m.URL})
+			break
+		}
+	}
+
+	// created_at is the last time the article changed, published_at when it was
+	// first published
+	createdAt := defaultCreatedAt
+	if item.PublishedParsed != nil {
+		createdAt = *item.PublishedParsed
+		tags = append(tags, nostr.Tag{"published_at", strconv.FormatInt(item.PublishedParsed.Unix(), 10)})
+	}
+	if item.UpdatedParsed != nil {
+		createdAt = *item.UpdatedParsed
+	}
+	if item.Link != "" {
+		tags = append(tags, nostr.Tag{"r", item.Link})
+	}
+	tags = append(tags, mediaTags(media)...)
+	tags = append(tags, hashtagTags(Hashtags(item, settings))...)
+	tags = append(tags, expirationTags(createdAt, settings)...)
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: createdAt,
+		Kind:      KindArticle,
+		Tags:      tags,
+		Content:   strings.ToValidUTF8(HTMLToMarkdown(body, item.Link), ""),
+	}
+	evt.ID = string(evt.Serialize())
+
+	return evt
+}
@@ -0,0 +1,51 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestItemToArticle(t *testing.T) {
+	published := time.Date(2023, time.February, 1, 10, 0, 0, 0, time.UTC)
+	updated := published.Add(48 * time.Hour)
+	item := &gofeed.Item{
+		Title:           "A &amp; B",
+		Description:     "<p>The <b>summary</b></p>",
+		Content:         `<p>Full <a href="/about">content</a></p>`,
+		Link:            "https://blog.example/posts/a-and-b",
+		GUID:            "urn:post:42",
+		PublishedParsed: &published,
+		UpdatedParsed:   &updated,
+		Enclosures:      []*gofeed.Enclosure{{URL: "https://blog.example/cover.jpg", Type: "image/jpeg"}},
+	}
+
+	evt := ItemToArticle(samplePubKey, item, sampleNow, Settings{})
+	assert.Equal(t, KindArticle, evt.Kind)
+	assert.Equal(t, samplePubKey, evt.PubKey)
+	assert.Equal(t, updated, evt.CreatedAt)
+	assert.Equal(t, "Full [content](https://blog.example/about)", evt.Content)
+	assert.Equal(t, nostr.Tags{
+		{"d", "urn:post:42"},
+		{"title", "A & B"},
+		{"summary", "The summary"},
+		{"image", "https://blog.example/cover.jpg"},
+		{"published_at", "1675245600"},
+		{"r", "https://blog.example/posts/a-and-b"},
+		{"imeta", "url https://blog.example/cover.jpg", "m image/jpeg"},
+	}, evt.Tags)
+}
+
+func TestItemToArticleWithoutContentUsesDescription(t *testing.T) {
+	item := &gofeed.Item{
+		Description: "<p>Only a description</p>",
+		Link:        "https://blog.example/posts/short",
+	}
+
+	evt := ItemToArticle(samplePubKey, item, sampleNow, Settings{})
+	assert.Equal(t, sampleNow, evt.CreatedAt)
+	assert.Equal(t, "Only a description", evt.Content)
+	assert.Equal(t, nostr.Tags{{"d", "https://blog.example/posts/short"}, {"r", "https://blog.example/posts/short"}}, evt.Tags)
+}
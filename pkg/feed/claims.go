@@ -0,0 +1,356 @@
+package feed
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClaimWellKnownPath is where publishers can place the proof of a claim on
+// the site of their feed, instead of in the feed itself.
+const ClaimWellKnownPath = "/.well-known/rsslay-claim.txt"
+
+// ClaimTTL is how long a claim can be verified after it is started.
+const ClaimTTL = 7 * 24 * time.Hour
+
+// Handover is how a claimed feed is handed over to its owner.
+type Handover string
+
+const (
+	// HandoverExport sends the private key of the feed to its owner.
+	HandoverExport Handover = "export"
+	// HandoverDelegation publishes the events of the feed on behalf of its
+	// owner with a NIP-26 delegation.
+	HandoverDelegation Handover = "delegation"
+)
+
+var (
+	ErrClaimNotFound    = errors.New("claim not found")
+	ErrClaimExpired     = errors.New("claim expired, start a new one")
+	ErrClaimNotVerified = errors.New("claim not verified yet")
+	ErrClaimCompleted   = errors.New("claim already completed")
+	ErrFeedClaimed      = errors.New("feed already claimed")
+	ErrProofNotFound    = errors.New("proof not found in the feed nor in " + ClaimWellKnownPath)
+)
+
+// Claim is the request of a publisher to own the profile of their feed. The
+// publisher proves control of the feed by placing the proof of the claim in it,
+// and then gets the feed handed over to the owner public key.
+type Claim struct {
+	Token       string
+	PublicKey   string
+	URL         string
+	Owner       string
+	CreatedAt   time.Time
+	VerifiedAt  time.Time
+	CompletedAt time.Time
+	Handover    Handover
+}
+
+// Proof is the text to place in the feed, or its well-known file, to verify
+// the claim.
+func (c Claim) Proof() string {
+	return "rsslay-claim-" + c.Token
+}
+
+func (c Claim) Verified() bool {
+	return !c.VerifiedAt.IsZero()
+}
+
+func (c Claim) Completed() bool {
+	return !c.CompletedAt.IsZero()
+}
+
+// StartClaim starts the claim of the feed with the given public key on behalf
+// of owner, who will receive the feed once the claim is verified.
+func StartClaim(pubkey string, owner string, now time.Time, db *sql.DB) (Claim, error) {
+	if key, err := hex.DecodeString(owner); err != nil || len(key) != 32 {
+		return Claim{}, errors.New("invalid owner public key")
+	}
+
+	claim := Claim{PublicKey: pubkey, Owner: owner, CreatedAt: time.Unix(now.Unix(), 0)}
+	var currentOwner string
+	err := db.QueryRow(`SELECT url, owner FROM feeds WHERE publickey=?`, pubkey).Scan(&claim.URL, &currentOwner)
+	if err == sql.ErrNoRows {
+		return Claim{}, fmt.Errorf("no feed with public key %s", pubkey)
+	} else if err != nil {
+		return Claim{}, fmt.Errorf("failed to retrieve feed: %w", err)
+	}
+	if currentOwner != "" {
+		return Claim{}, ErrFeedClaimed
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return Claim{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+	claim.Token = hex.EncodeToString(token)
+	if _, err := db.Exec(`INSERT INTO feed_claims (token, publickey, owner, created_at) VALUES (?, ?, ?, ?)`, claim.Token, pubkey, owner, claim.CreatedAt.Unix()); err != nil {
+		return Claim{}, fmt.Errorf("failed to store claim: %w", err)
+	}
+	return claim, nil
+}
+
+// GetClaim returns the claim with the given token.
+func GetClaim(token string, db *sql.DB) (Claim, error) {
+	claim := Claim{Token: token}
+	var createdAt, verifiedAt, completedAt int64
+	err := db.QueryRow(`SELECT c.publickey, f.url, c.owner, c.created_at, c.verified_at, c.completed_at, c.handover FROM feed_claims c JOIN feeds f ON f.publickey=c.publickey WHERE c.token=?`, token).
+		Scan(&claim.PublicKey, &claim.URL, &claim.Owner, &createdAt, &verifiedAt, &completedAt, &claim.Handover)
+	if err == sql.ErrNoRows {
+		return Claim{}, ErrClaimNotFound
+	} else if err != nil {
+		return Claim{}, fmt.Errorf("failed to retrieve claim: %w", err)
+	}
+	claim.CreatedAt = time.Unix(createdAt, 0)
+	if verifiedAt > 0 {
+		claim.VerifiedAt = time.Unix(verifiedAt, 0)
+	}
+	if completedAt > 0 {
+		claim.CompletedAt = time.Unix(completedAt, 0)
+	}
+	return claim, nil
+}
+
+// VerifyClaim looks for the proof of the claim in the title, description or
+// copyright of the feed, or in the well-known file of its site, and marks the
+// claim as verified if found.
+func VerifyClaim(claim Claim, now time.Time, db *sql.DB) (Claim, error) {
+	switch {
+	case claim.Completed():
+		return claim, ErrClaimCompleted
+	case claim.Verified():
+		return claim, nil
+	case now.Sub(claim.CreatedAt) > ClaimTTL:
+		return claim, ErrClaimExpired
+	}
+
+	if !HasProof(claim.URL, claim.Proof()) {
+		return claim, ErrProofNotFound
+	}
+
+	claim.VerifiedAt = time.Unix(now.Unix(), 0)
+	if _, err := db.Exec(`UPDATE feed_claims SET verified_at=? WHERE token=?`, claim.VerifiedAt.Unix(), claim.Token); err != nil {
+		return claim, fmt.Errorf("failed to verify claim: %w", err)
+	}
+	return claim, nil
+}
+
+// OwnerProof is the text to place in a feed, or its well-known file, to create
+// its profile with the key of the owner with the given public key.
+func OwnerProof(pubkey string) string {
+	return "rsslay-owner-" + pubkey
+}
+
+// WellKnownURL returns the url of the well-known file of the site of a feed,
+// where proofs can be placed instead of the feed.
+func WellKnownURL(feedUrl string) string {
+	u, err := url.Parse(feedUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + ClaimWellKnownPath
+}
+
+// HasProof reports whether whoever controls the feed at the given url placed
+// the proof in it or in the well-known file of its site.
+func HasProof(feedUrl string, proof string) bool {
+	if feedContainsProof(feedUrl, proof) {
+		return true
+	}
+	wellKnownUrl := WellKnownURL(feedUrl)
+	if wellKnownUrl == "" {
+		return false
+	}
+	body, ok := fetchDocument(wellKnownUrl)
+	return ok && strings.Contains(string(body), proof)
+}
+
+// feedContainsProof reports whether the feed at the given url has the proof of
+// a claim in its title, description or copyright. Only the site can change
+// those, unlike items, which may quote comments or posts of anyone.
+func feedContainsProof(feedUrl string, proof string) bool {
+	body, ok := fetchDocument(feedUrl)
+	if !ok {
+		return false
+	}
+	parsedFeed, err := ParseContent(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	for _, field := range []string{parsedFeed.Title, parsedFeed.Description, parsedFeed.Copyright} {
+		if strings.Contains(field, proof) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDocument returns the body of the document at the given url, and false
+// if it can't be retrieved.
+func fetchDocument(documentUrl string) ([]byte, bool) {
+	req, err := http.NewRequest(http.MethodGet, documentUrl, nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 5<<20))
+	return body, err == nil
+}
+
+// KeyExport returns the unsigned NIP-04 direct message from the feed to the
+// owner of a verified claim with the private key of the feed.
+func KeyExport(claim Claim, sk string, now time.Time) (nostr.Event, error) {
+	if !claim.Verified() {
+		return nostr.Event{}, ErrClaimNotVerified
+	}
+	nsec, err := nip19.EncodePrivateKey(sk)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	secret, err := nip04.ComputeSharedSecret(claim.Owner, sk)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	content, err := nip04.Encrypt(fmt.Sprintf("This is the private key of the profile of %s on rsslay, keep it safe: %s", claim.URL, nsec), secret)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	return nostr.Event{
+		PubKey:    claim.PublicKey,
+		CreatedAt: now,
+		Kind:      nostr.KindEncryptedDirectMessage,
+		Tags:      nostr.Tags{{"p", claim.Owner}},
+		Content:   content,
+	}, nil
+}
+
+// DelegationConditions are the NIP-26 conditions the owner of a verified claim
+// delegates under: every event created after the claim was verified.
+func (c Claim) DelegationConditions() string {
+	return "created_at>" + strconv.FormatInt(c.VerifiedAt.Unix(), 10)
+}
+
+// DelegationToken is the NIP-26 delegation string the owner of a claim signs
+// to delegate to the feed.
+func (c Claim) DelegationToken() string {
+	return "nostr:delegation:" + c.PublicKey + ":" + c.DelegationConditions()
+}
+
+// CompleteClaim hands the feed of a verified claim over to its owner. The
+// delegation signature is required, and checked, when handing over with a
+// delegation.
+func CompleteClaim(claim Claim, handover Handover, delegationSig string, now time.Time, db *sql.DB) error {
+	if claim.Completed() {
+		return ErrClaimCompleted
+	}
+	if !claim.Verified() {
+		return ErrClaimNotVerified
+	}
+
+	delegation := ""
+	switch handover {
+	case HandoverExport:
+	case HandoverDelegation:
+		if !validDelegation(claim.Owner, claim.DelegationToken(), delegationSig) {
+			return errors.New("invalid delegation signature")
+		}
+		tag, _ := json.Marshal(nostr.Tag{"delegation", claim.Owner, claim.DelegationConditions(), delegationSig})
+		delegation = string(tag)
+	default:
+		return fmt.Errorf("unknown handover %q", handover)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE feeds SET owner=?, delegation=? WHERE publickey=? AND owner=''`, claim.Owner, delegation, claim.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to hand over feed: %w", err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return ErrFeedClaimed
+	}
+	if _, err := tx.Exec(`UPDATE feed_claims SET completed_at=?, handover=? WHERE token=?`, now.Unix(), handover, claim.Token); err != nil {
+		return fmt.Errorf("failed to complete claim: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Delegation returns the NIP-26 delegation tag to add to the events of the
+// feed with the given public key, or nil if its owner hasn't delegated to it.
+func Delegation(pubkey string, db *sql.DB) nostr.Tag {
+	var stored string
+	if err := db.QueryRow(`SELECT delegation FROM feeds WHERE publickey=?`, pubkey).Scan(&stored); err != nil || stored == "" {
+		return nil
+	}
+	var tag nostr.Tag
+	if err := json.Unmarshal([]byte(stored), &tag); err != nil {
+		return nil
+	}
+	return tag
+}
+
+// Delegate adds a NIP-26 delegation tag to an event if the event meets its
+// conditions, as items published before the delegation don't.
+func Delegate(evt *nostr.Event, delegation nostr.Tag) {
+	if len(delegation) < 4 {
+		return
+	}
+	for _, condition := range strings.Split(delegation[2], "&") {
+		if since, found := strings.CutPrefix(condition, "created_at>"); found {
+			if s, err := strconv.ParseInt(since, 10, 64); err != nil || evt.CreatedAt.Unix() <= s {
+				return
+			}
+		}
+	}
+	evt.Tags = append(evt.Tags, delegation)
+}
+
+func validDelegation(delegator string, token string, sig string) bool {
+	pk, err := hex.DecodeString(delegator)
+	if err != nil {
+		return false
+	}
+	pubkey, err := schnorr.ParsePubKey(pk)
+	if err != nil {
+		return false
+	}
+	s, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	signature, err := schnorr.ParseSignature(s)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(token))
+	return signature.Verify(hash[:], pubkey)
+}
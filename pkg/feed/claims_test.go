@@ -0,0 +1,174 @@
+package feed
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleOwnerPrivateKey = "5aa8b66a0a6fa3d2a0ac0bd5ad0fc8c1b8b8ddc1b07b2bd4f9a6ab8fd8f7e3a1"
+
+func startTestClaim(t *testing.T, db *sql.DB, feedUrl string) Claim {
+	owner, _ := nostr.GetPublicKey(sampleOwnerPrivateKey)
+	_, _ = db.Exec(`INSERT INTO feeds (publickey, privatekey, url) VALUES (?, ?, ?)`, samplePubKey, samplePrivateKeyForPubKey, feedUrl)
+	claim, err := StartClaim(samplePubKey, owner, sampleNow, db)
+	assert.NoError(t, err)
+	return claim
+}
+
+func TestClaimIsVerifiedWithTheProofInTheFeed(t *testing.T) {
+	db := testdb.Open(t)
+	content := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>Blog</title><description>` + content + `</description></channel></rss>`))
+	}))
+	defer server.Close()
+
+	claim := startTestClaim(t, db, server.URL+"/feed.xml")
+	assert.False(t, claim.Verified())
+
+	_, err := VerifyClaim(claim, sampleNow, db)
+	assert.ErrorIs(t, err, ErrProofNotFound)
+
+	content = "My blog " + claim.Proof()
+	verified, err := VerifyClaim(claim, sampleNow.Add(time.Hour), db)
+	assert.NoError(t, err)
+	assert.True(t, verified.Verified())
+
+	stored, err := GetClaim(claim.Token, db)
+	assert.NoError(t, err)
+	assert.Equal(t, verified, stored)
+	assert.Equal(t, server.URL+"/feed.xml", stored.URL)
+}
+
+func TestClaimIsNotVerifiedWithTheProofInAnItem(t *testing.T) {
+	db := testdb.Open(t)
+	proof := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>Blog</title><description>My blog</description>` +
+			`<item><title>Comment</title><description>Anyone can write ` + proof + `</description></item></channel></rss>`))
+	}))
+	defer server.Close()
+
+	claim := startTestClaim(t, db, server.URL+"/feed.xml")
+	proof = claim.Proof()
+	_, err := VerifyClaim(claim, sampleNow, db)
+	assert.ErrorIs(t, err, ErrProofNotFound)
+}
+
+func TestClaimIsVerifiedWithTheProofInTheWellKnownFile(t *testing.T) {
+	db := testdb.Open(t)
+	proof := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == ClaimWellKnownPath {
+			_, _ = w.Write([]byte(proof))
+			return
+		}
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>Blog</title></channel></rss>`))
+	}))
+	defer server.Close()
+
+	claim := startTestClaim(t, db, server.URL+"/blog/feed.xml")
+	proof = claim.Proof() + "\n"
+	verified, err := VerifyClaim(claim, sampleNow, db)
+	assert.NoError(t, err)
+	assert.True(t, verified.Verified())
+}
+
+func TestExpiredClaimsAreNotVerified(t *testing.T) {
+	db := testdb.Open(t)
+	claim := startTestClaim(t, db, "https://blog.example/feed.xml")
+
+	_, err := VerifyClaim(claim, sampleNow.Add(ClaimTTL+time.Second), db)
+	assert.ErrorIs(t, err, ErrClaimExpired)
+}
+
+func TestKeyExportIsEncryptedToTheOwner(t *testing.T) {
+	db := testdb.Open(t)
+	claim := startTestClaim(t, db, "https://blog.example/feed.xml")
+
+	_, err := KeyExport(claim, samplePrivateKeyForPubKey, sampleNow)
+	assert.ErrorIs(t, err, ErrClaimNotVerified)
+	assert.ErrorIs(t, CompleteClaim(claim, HandoverExport, "", sampleNow, db), ErrClaimNotVerified)
+
+	claim.VerifiedAt = sampleNow
+	message, err := KeyExport(claim, samplePrivateKeyForPubKey, sampleNow)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, message.PubKey)
+	assert.Equal(t, nostr.KindEncryptedDirectMessage, message.Kind)
+	assert.Equal(t, claim.Owner, message.Tags.GetFirst([]string{"p"}).Value())
+
+	secret, _ := nip04.ComputeSharedSecret(samplePubKey, sampleOwnerPrivateKey)
+	text, err := nip04.Decrypt(message.Content, secret)
+	assert.NoError(t, err)
+	assert.Contains(t, text, "nsec1")
+
+	assert.NoError(t, CompleteClaim(claim, HandoverExport, "", sampleNow, db))
+	assert.Nil(t, Delegation(samplePubKey, db))
+	stored, _ := GetClaim(claim.Token, db)
+	assert.True(t, stored.Completed())
+	assert.Equal(t, HandoverExport, stored.Handover)
+
+	// Claimed feeds can't be claimed again
+	assert.ErrorIs(t, CompleteClaim(stored, HandoverExport, "", sampleNow, db), ErrClaimCompleted)
+	_, err = StartClaim(samplePubKey, claim.Owner, sampleNow, db)
+	assert.ErrorIs(t, err, ErrFeedClaimed)
+}
+
+func TestDelegationRequiresTheSignatureOfTheOwner(t *testing.T) {
+	db := testdb.Open(t)
+	claim := startTestClaim(t, db, "https://blog.example/feed.xml")
+	claim.VerifiedAt = sampleNow
+	assert.Equal(t, "nostr:delegation:"+samplePubKey+":created_at>"+"1675677600", claim.DelegationToken())
+
+	sign := func(sk string, token string) string {
+		key, _ := hex.DecodeString(sk)
+		privateKey, _ := btcec.PrivKeyFromBytes(key)
+		hash := sha256.Sum256([]byte(token))
+		sig, _ := schnorr.Sign(privateKey, hash[:])
+		return hex.EncodeToString(sig.Serialize())
+	}
+
+	// Signed by someone else or for other conditions
+	assert.Error(t, CompleteClaim(claim, HandoverDelegation, sign(samplePrivateKeyForPubKey, claim.DelegationToken()), sampleNow, db))
+	assert.Error(t, CompleteClaim(claim, HandoverDelegation, sign(sampleOwnerPrivateKey, strings.TrimSuffix(claim.DelegationToken(), "0")), sampleNow, db))
+	assert.Nil(t, Delegation(samplePubKey, db))
+
+	sig := sign(sampleOwnerPrivateKey, claim.DelegationToken())
+	assert.NoError(t, CompleteClaim(claim, HandoverDelegation, sig, sampleNow, db))
+	assert.Equal(t, nostr.Tag{"delegation", claim.Owner, claim.DelegationConditions(), sig}, Delegation(samplePubKey, db))
+}
+
+func TestDelegateOnlyEventsMeetingTheConditions(t *testing.T) {
+	delegation := nostr.Tag{"delegation", "owner", "created_at>1675677600", "sig"}
+
+	before := nostr.Event{CreatedAt: sampleNow}
+	Delegate(&before, delegation)
+	assert.Empty(t, before.Tags)
+
+	after := nostr.Event{CreatedAt: sampleNow.Add(time.Second), Tags: nostr.Tags{{"t", "nostr"}}}
+	Delegate(&after, delegation)
+	assert.Equal(t, nostr.Tags{{"t", "nostr"}, delegation}, after.Tags)
+
+	Delegate(&after, nil)
+	assert.Len(t, after.Tags, 2)
+}
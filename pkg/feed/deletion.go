@@ -0,0 +1,38 @@
+package feed
+
+import (
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+// ItemDeletion returns a NIP-09 deletion of the events published for an item,
+// referencing them by id, and replaceable ones like articles by their address
+// as well, so later versions are covered too.
+func ItemDeletion(pubkey string, published []nostr.Event, createdAt time.Time, reason string) nostr.Event {
+	tags := nostr.Tags{}
+	for _, evt := range published {
+		tags = append(tags, nostr.Tag{"e", evt.ID})
+	}
+	for _, evt := range published {
+		if evt.Kind < 30000 || evt.Kind >= 40000 {
+			continue
+		}
+		identifier := ""
+		if d := evt.Tags.GetFirst([]string{"d", ""}); d != nil {
+			identifier = d.Value()
+		}
+		tags = append(tags, nostr.Tag{"a", fmt.Sprintf("%d:%s:%s", evt.Kind, evt.PubKey, identifier)})
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: createdAt,
+		Kind:      nostr.KindDeletion,
+		Tags:      tags,
+		Content:   reason,
+	}
+	evt.ID = string(evt.Serialize())
+
+	return evt
+}
@@ -0,0 +1,96 @@
+package feed
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"time"
+)
+
+// EditPolicy tells how the edits of items already published as notes are
+// handled. Articles are replaceable, so they are always updated.
+type EditPolicy string
+
+const (
+	// EditsIgnore keeps the note first published for each item.
+	EditsIgnore EditPolicy = "ignore"
+	// EditsCorrect publishes a new note replying to the previous one.
+	EditsCorrect EditPolicy = "correct"
+	// EditsReplace deletes the previous note and publishes a new one.
+	EditsReplace EditPolicy = "replace"
+)
+
+// ParseEditPolicy validates an edit policy, accepting empty ones.
+func ParseEditPolicy(policy string) (EditPolicy, error) {
+	switch EditPolicy(policy) {
+	case "", EditsIgnore, EditsCorrect, EditsReplace:
+		return EditPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown edit policy %q", policy)
+	}
+}
+
+// ItemVersion returns a hash of the content and update date of an item, which
+// changes whenever the item is edited.
+func ItemVersion(item *gofeed.Item) string {
+	updated := ""
+	if item.UpdatedParsed != nil {
+		updated = strconv.FormatInt(item.UpdatedParsed.Unix(), 10)
+	}
+	hash := sha256.Sum256([]byte(item.Title + "\n" + item.Description + "\n" + item.Content + "\n" + updated))
+	return hex.EncodeToString(hash[:])
+}
+
+// IsEdited tells whether the current version of the item of the feed with the
+// given public key differs from the one recorded before. Items recorded before
+// versions were tracked are not edits.
+func IsEdited(pubkey string, item *gofeed.Item, db *sql.DB) (bool, error) {
+	key := ItemKey(item)
+	var previous string
+	err := db.QueryRow(`SELECT version FROM items WHERE publickey=? AND item_key=?`, pubkey, key).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to retrieve version of item %q: %w", key, err)
+	}
+	return previous != "" && previous != ItemVersion(item), nil
+}
+
+// RecordVersion records the current version of the item of the feed with the
+// given public key. It is called once the events of the item are stored, so
+// edits failing to be published are detected again.
+func RecordVersion(pubkey string, item *gofeed.Item, db *sql.DB) error {
+	key := ItemKey(item)
+	if _, err := db.Exec(`UPDATE items SET version=? WHERE publickey=? AND item_key=?`, ItemVersion(item), pubkey, key); err != nil {
+		return fmt.Errorf("failed to record version of item %q: %w", key, err)
+	}
+	return nil
+}
+
+// EditedAt returns the date of the event republishing an edited item: its
+// update date if it is newer than the previous event, or the time the edit was
+// detected otherwise, as edits of the content alone keep the dates of the item.
+func EditedAt(item *gofeed.Item, previous time.Time, detectedAt time.Time) time.Time {
+	if item.UpdatedParsed != nil && item.UpdatedParsed.After(previous) {
+		return *item.UpdatedParsed
+	}
+	return detectedAt
+}
+
+// Correction turns the note of an edited item into a reply to the notes
+// previously published for it, newest first, dated when the item was edited.
+func Correction(note nostr.Event, previous []nostr.Event, editedAt time.Time) nostr.Event {
+	tags := nostr.Tags{{"e", previous[len(previous)-1].ID, "", "root"}}
+	if len(previous) > 1 {
+		tags = append(tags, nostr.Tag{"e", previous[0].ID, "", "reply"})
+	}
+
+	note.Tags = append(tags, note.Tags...)
+	note.CreatedAt = editedAt
+	note.Sig = ""
+	note.ID = string(note.Serialize())
+
+	return note
+}
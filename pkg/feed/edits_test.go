@@ -0,0 +1,76 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseEditPolicy(t *testing.T) {
+	for _, policy := range []string{"", "ignore", "correct", "replace"} {
+		parsed, err := ParseEditPolicy(policy)
+		assert.NoError(t, err)
+		assert.Equal(t, EditPolicy(policy), parsed)
+	}
+	_, err := ParseEditPolicy("republish")
+	assert.Error(t, err)
+}
+
+func TestRecordVersionDetectsEdits(t *testing.T) {
+	db := testdb.Open(t)
+	item := &gofeed.Item{GUID: "urn:1", Title: "Title", Description: "First version"}
+	assert.NoError(t, RecordPresence(samplePubKey, []*gofeed.Item{item}, sampleNow, db))
+	edited := func() bool {
+		edited, err := IsEdited(samplePubKey, item, db)
+		assert.NoError(t, err)
+		return edited
+	}
+
+	// The first version of an item is not an edit
+	assert.False(t, edited())
+	assert.NoError(t, RecordVersion(samplePubKey, item, db))
+	assert.False(t, edited())
+
+	// Edits are detected until their version is recorded
+	item.Description = "Second version"
+	assert.True(t, edited())
+	assert.True(t, edited())
+	assert.NoError(t, RecordVersion(samplePubKey, item, db))
+	assert.False(t, edited())
+
+	updated := sampleNow.Add(time.Hour)
+	item.UpdatedParsed = &updated
+	assert.True(t, edited())
+}
+
+func TestEditedAtIsNewerThanThePreviousEvent(t *testing.T) {
+	detectedAt := sampleNow.Add(2 * time.Hour)
+
+	// Edits of the content alone are dated when they are detected
+	item := &gofeed.Item{PublishedParsed: &sampleNow}
+	assert.Equal(t, detectedAt, EditedAt(item, sampleNow, detectedAt))
+
+	updated := sampleNow.Add(time.Hour)
+	item.UpdatedParsed = &updated
+	assert.Equal(t, updated, EditedAt(item, sampleNow, detectedAt))
+	assert.Equal(t, detectedAt, EditedAt(item, updated, detectedAt))
+}
+
+func TestCorrectionRepliesToPreviousNotes(t *testing.T) {
+	original := nostr.Event{ID: "original", CreatedAt: sampleNow}
+	note := nostr.Event{PubKey: samplePubKey, CreatedAt: sampleNow, Kind: nostr.KindTextNote, Tags: nostr.Tags{{"t", "news"}}, Content: "Second version"}
+	editedAt := sampleNow.Add(time.Hour)
+
+	correction := Correction(note, []nostr.Event{original}, editedAt)
+	assert.Equal(t, nostr.Tags{{"e", "original", "", "root"}, {"t", "news"}}, correction.Tags)
+	assert.Equal(t, editedAt, correction.CreatedAt)
+	assert.Equal(t, "Second version", correction.Content)
+	assert.NotEqual(t, note.ID, correction.ID)
+
+	first := nostr.Event{ID: "first-correction", CreatedAt: editedAt}
+	correction = Correction(note, []nostr.Event{first, original}, editedAt.Add(time.Hour))
+	assert.Equal(t, nostr.Tags{{"e", "original", "", "root"}, {"e", "first-correction", "", "reply"}, {"t", "news"}}, correction.Tags)
+}
@@ -0,0 +1,149 @@
+package feed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedKeyPrefix marks the private keys stored encrypted, with the version
+// of the format.
+const encryptedKeyPrefix = "enc1:"
+
+// ErrNoKeyEncryptionKey is returned when opening an encrypted private key
+// without a key encryption key.
+var ErrNoKeyEncryptionKey = errors.New("private key is encrypted but no key encryption key is configured")
+
+// KeyCipher encrypts the private keys of feeds at rest with AES-256-GCM, bound
+// to the public key of each feed so stored keys can't be swapped between feeds.
+// A nil KeyCipher stores keys in plain text.
+type KeyCipher struct {
+	aead cipher.AEAD
+}
+
+// NewKeyCipher returns a cipher for the given key encryption key, 32 bytes in
+// hex, or nil if it is empty.
+func NewKeyCipher(kek string) (*KeyCipher, error) {
+	if kek == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(kek)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the key encryption key must be 32 bytes in hex")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyCipher{aead: aead}, nil
+}
+
+// Seal returns the private key of the feed with the given public key as it
+// must be stored.
+func (c *KeyCipher) Seal(pubkey string, sk string) (string, error) {
+	if c == nil {
+		return sk, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(sk), []byte(pubkey))
+	return encryptedKeyPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open returns the private key of the feed with the given public key from its
+// stored value. Keys stored in plain text are returned as they are.
+func (c *KeyCipher) Open(pubkey string, stored string) (string, error) {
+	if !IsEncryptedKey(stored) {
+		return stored, nil
+	}
+	if c == nil {
+		return "", ErrNoKeyEncryptionKey
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedKeyPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("malformed encrypted private key")
+	}
+	nonceSize := c.aead.NonceSize()
+	sk, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(pubkey))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt private key of %s: %w", pubkey, err)
+	}
+	return string(sk), nil
+}
+
+// IsEncryptedKey reports whether a stored private key is encrypted.
+func IsEncryptedKey(stored string) bool {
+	return strings.HasPrefix(stored, encryptedKeyPrefix)
+}
+
+// EncryptStoredKeys encrypts the private keys still stored in plain text,
+// returning how many were encrypted. Feeds whose key is held by a bunker have
+// none. Without a cipher, it fails if any key is already encrypted, as those
+// feeds couldn't sign their events.
+func EncryptStoredKeys(c *KeyCipher, db *sql.DB) (int, error) {
+	rows, err := db.Query(`SELECT publickey, privatekey FROM feeds WHERE privatekey<>''`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve private keys: %w", err)
+	}
+
+	plain := map[string]string{}
+	for rows.Next() {
+		var pubkey, stored string
+		if err := rows.Scan(&pubkey, &stored); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to scan private key: %w", err)
+		}
+		if IsEncryptedKey(stored) {
+			if c == nil {
+				_ = rows.Close()
+				return 0, ErrNoKeyEncryptionKey
+			}
+			continue
+		}
+		plain[pubkey] = stored
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if c == nil {
+		return 0, nil
+	}
+
+	for pubkey, sk := range plain {
+		sealed, err := c.Seal(pubkey, sk)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := db.Exec(`UPDATE feeds SET privatekey=? WHERE publickey=? AND privatekey=?`, sealed, pubkey, sk); err != nil {
+			return 0, fmt.Errorf("failed to encrypt private key of %s: %w", pubkey, err)
+		}
+	}
+	return len(plain), nil
+}
+
+// StoredPrivateKey returns the private key of the feed with the given public
+// key, opening it if it is stored encrypted.
+func StoredPrivateKey(pubkey string, c *KeyCipher, db *sql.DB) (string, error) {
+	var stored string
+	err := db.QueryRow(`SELECT privatekey FROM feeds WHERE publickey=?`, pubkey).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no feed with public key %s", pubkey)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to retrieve private key of %s: %w", pubkey, err)
+	} else if stored == "" {
+		return "", fmt.Errorf("the private key of %s is held by a bunker", pubkey)
+	}
+	return c.Open(pubkey, stored)
+}
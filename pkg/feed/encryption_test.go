@@ -0,0 +1,88 @@
+package feed
+
+import (
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const sampleKeyEncryptionKey = "6b1c2f0e8a4d3b5c7e9f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f"
+
+func TestKeyCipherSealsKeysForTheirFeed(t *testing.T) {
+	keyCipher, err := NewKeyCipher(sampleKeyEncryptionKey)
+	assert.NoError(t, err)
+
+	sealed, err := keyCipher.Seal(samplePubKey, samplePrivateKeyForPubKey)
+	assert.NoError(t, err)
+	assert.True(t, IsEncryptedKey(sealed))
+	assert.NotContains(t, sealed, samplePrivateKeyForPubKey)
+
+	sk, err := keyCipher.Open(samplePubKey, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePrivateKeyForPubKey, sk)
+
+	// Keys stored for another feed can't be opened
+	_, err = keyCipher.Open("other", sealed)
+	assert.Error(t, err)
+
+	// Keys still in plain text are returned as they are
+	sk, err = keyCipher.Open(samplePubKey, samplePrivateKeyForPubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePrivateKeyForPubKey, sk)
+
+	other, _ := NewKeyCipher(strings.Repeat("00", 32))
+	_, err = other.Open(samplePubKey, sealed)
+	assert.Error(t, err)
+}
+
+func TestNilKeyCipherStoresKeysInPlainText(t *testing.T) {
+	keyCipher, err := NewKeyCipher("")
+	assert.NoError(t, err)
+	assert.Nil(t, keyCipher)
+
+	stored, err := keyCipher.Seal(samplePubKey, samplePrivateKeyForPubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePrivateKeyForPubKey, stored)
+
+	_, err = keyCipher.Open(samplePubKey, "enc1:AAAA")
+	assert.ErrorIs(t, err, ErrNoKeyEncryptionKey)
+
+	for _, kek := range []string{"not hex", "00ff"} {
+		_, err := NewKeyCipher(kek)
+		assert.Error(t, err)
+	}
+}
+
+func TestEncryptStoredKeys(t *testing.T) {
+	db := testdb.Open(t)
+	_, _ = db.Exec(`INSERT INTO feeds (publickey, privatekey, url) VALUES (?, ?, ?)`, samplePubKey, samplePrivateKeyForPubKey, "https://blog.example/rss")
+	// Keys held by bunkers aren't stored
+	_, _ = db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_source) VALUES ('remote', '', ?, ?)`, "https://owned.example/rss", KeyRemote)
+
+	encrypted, err := EncryptStoredKeys(nil, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, encrypted)
+
+	keyCipher, _ := NewKeyCipher(sampleKeyEncryptionKey)
+	encrypted, err = EncryptStoredKeys(keyCipher, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, encrypted)
+	encrypted, err = EncryptStoredKeys(keyCipher, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, encrypted)
+
+	sk, err := StoredPrivateKey(samplePubKey, keyCipher, db)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePrivateKeyForPubKey, sk)
+	_, err = StoredPrivateKey("other", keyCipher, db)
+	assert.Error(t, err)
+	_, err = StoredPrivateKey("remote", keyCipher, db)
+	assert.ErrorContains(t, err, "held by a bunker")
+
+	// Encrypted keys can't be used without the key encryption key
+	_, err = EncryptStoredKeys(nil, db)
+	assert.ErrorIs(t, err, ErrNoKeyEncryptionKey)
+	_, err = StoredPrivateKey(samplePubKey, nil, db)
+	assert.ErrorIs(t, err, ErrNoKeyEncryptionKey)
+}
@@ -0,0 +1,16 @@
+package feed
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"time"
+)
+
+// expirationTags returns the NIP-40 expiration tag of an event created at the
+// given time, if the feed has a TTL.
+func expirationTags(createdAt time.Time, settings Settings) nostr.Tags {
+	if settings.TTL <= 0 {
+		return nil
+	}
+	return nostr.Tags{{"expiration", strconv.FormatInt(createdAt.Add(settings.TTL).Unix(), 10)}}
+}
@@ -0,0 +1,32 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEventsOfFeedsWithTTLExpire(t *testing.T) {
+	published := sampleNow.Add(-time.Hour)
+	item := &gofeed.Item{Title: "Storm warning", Link: "https://weather.example/1", PublishedParsed: &published}
+	parsedFeed := &gofeed.Feed{Items: []*gofeed.Item{item}}
+	settings := Settings{MaxNoteLength: 250, TTL: 48 * time.Hour}
+	expiration := nostr.Tag{"expiration", strconv.FormatInt(published.Add(48*time.Hour).Unix(), 10)}
+
+	note := ItemToTextNote(samplePubKey, item, parsedFeed, sampleNow, "https://weather.example/rss", settings)
+	assert.Equal(t, &expiration, note.Tags.GetFirst([]string{"expiration", ""}))
+
+	article := ItemToArticle(samplePubKey, item, sampleNow, settings)
+	assert.Equal(t, &expiration, article.Tags.GetFirst([]string{"expiration", ""}))
+
+	note = ItemToTextNote(samplePubKey, item, parsedFeed, sampleNow, "https://weather.example/rss", Settings{MaxNoteLength: 250})
+	assert.Nil(t, note.Tags.GetFirst([]string{"expiration", ""}))
+}
+
+func TestOptionsTTLOverridesDefault(t *testing.T) {
+	assert.Equal(t, time.Duration(0), Options{}.Settings(Settings{}).TTL)
+	assert.Equal(t, time.Hour, Options{TTL: time.Hour}.Settings(Settings{}).TTL)
+}
@@ -6,14 +6,15 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
-	strip "github.com/grokify/html-strip-tags-go"
 	"github.com/mmcdole/gofeed"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/piraces/rsslay/pkg/helpers"
 	"github.com/rif/cache2go"
 	"html"
+	"io"
 	"log"
 	"net/http"
 	"strings"
@@ -26,10 +27,17 @@ var (
 	client    = &http.Client{
 		Timeout: 5 * time.Second,
 	}
+	feedClient = &http.Client{
+		Timeout: 15 * time.Second,
+	}
 )
 
+const userAgent = "rsslay (+https://github.com/piraces/rsslay)"
+
 type Entity struct {
-	PublicKey  string
+	PublicKey string
+	// PrivateKey is the private key as stored, encrypted when a key encryption
+	// key is configured. It is only opened to sign events.
 	PrivateKey string
 	URL        string
 }
@@ -95,6 +103,90 @@ func ParseFeed(url string) (*gofeed.Feed, error) {
 	return feed, nil
 }
 
+// CacheValidators are the HTTP validators of the last response of a feed, sent
+// back on the next request so unchanged feeds can answer with a 304.
+type CacheValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// ErrNotModified is returned by FetchFeed when the feed has not changed since
+// the response the validators were taken from.
+var ErrNotModified = errors.New("feed not modified")
+
+// ErrNotProcessed is returned for feeds fetched fine whose events could not all
+// be signed or stored. It is not a failure of the feed itself.
+var ErrNotProcessed = errors.New("feed not fully processed")
+
+// FetchFeed fetches and parses a feed with a conditional request, returning the
+// validators of the new response. Unchanged feeds are not parsed at all and
+// ErrNotModified is returned instead.
+func FetchFeed(url string, validators CacheValidators) (*gofeed.Feed, CacheValidators, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, validators, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, validators, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, validators, ErrNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, validators, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	feed, err := ParseContent(resp.Body)
+	if err != nil {
+		return nil, validators, err
+	}
+	setWebSubLinksFromHeader(feed, resp.Header)
+	feedCache.Set(url, feed)
+
+	return feed, CacheValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// ParseContent parses a feed document, such as the body of a response or of a
+// WebSub notification. The full content of the items is kept for articles.
+func ParseContent(content io.Reader) (*gofeed.Feed, error) {
+	// Parsers keep state while parsing, so they can't be shared between polls
+	return newParser().Parse(content)
+}
+
+// GetCacheValidators returns the validators stored for the feed with the given url.
+func GetCacheValidators(url string, db *sql.DB) CacheValidators {
+	var validators CacheValidators
+	row := db.QueryRow(`SELECT etag, last_modified FROM feeds WHERE url=?`, url)
+	if err := row.Scan(&validators.ETag, &validators.LastModified); err != nil && err != sql.ErrNoRows {
+		log.Printf("failure to retrieve cache validators: " + err.Error())
+	}
+	return validators
+}
+
+// SaveCacheValidators stores the validators of the last response of the feed with the given url.
+func SaveCacheValidators(url string, validators CacheValidators, db *sql.DB) {
+	if _, err := db.Exec(`UPDATE feeds SET etag=?, last_modified=? WHERE url=?`, validators.ETag, validators.LastModified, url); err != nil {
+		log.Printf("failure to save cache validators: " + err.Error())
+	}
+}
+
 func FeedToSetMetadata(pubkey string, feed *gofeed.Feed, originalUrl string, enableAutoRegistration bool, defaultProfilePictureUrl string) nostr.Event {
 	// Handle Nitter special cases (http schema)
 	if strings.Contains(feed.Description, "Twitter feed") {
@@ -140,17 +232,20 @@ func FeedToSetMetadata(pubkey string, feed *gofeed.Feed, originalUrl string, ena
 	return evt
 }
 
-func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, defaultCreatedAt time.Time, originalUrl string) nostr.Event {
+// ItemToTextNote converts an item into a note with its title and description,
+// truncated to the maximum length, followed by its media and the link to the
+// item. The categories of the item become hashtags.
+func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, defaultCreatedAt time.Time, originalUrl string, settings Settings) nostr.Event {
 	content := ""
 	if item.Title != "" {
-		content = "**" + item.Title + "**\n\n"
+		content = "**" + html.UnescapeString(item.Title) + "**\n\n"
 	}
 
-	description := strip.StripTags(item.Description)
+	description := HTMLToText(item.Description, item.Link)
 
-	// Handle stacker.news comments
+	// Handle stacker.news comments, whose link is the guid of the item
 	if strings.Contains(feed.Link, "stacker.news") {
-		description += fmt.Sprintf(": %s", item.GUID)
+		description = strings.TrimSpace(strings.TrimSuffix(description, item.GUID)) + fmt.Sprintf(": %s", item.GUID)
 	}
 
 	if !strings.EqualFold(item.Title, description) {
@@ -182,9 +277,19 @@ func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, default
 		content += description
 	}
 
-	content = html.UnescapeString(content)
-	if len(content) > 250 {
-		content = content[0:249] + "…"
+	content = Truncate(content, settings.MaxNoteLength)
+
+	// Media go on their own lines so clients show players and images inline
+	media := ItemMedia(item)
+	for _, m := range media {
+		if !strings.Contains(content, m.URL) {
+			content += "\n\n" + m.URL
+		}
+	}
+
+	hashtags := Hashtags(item, settings)
+	if settings.AppendHashtags && len(hashtags) > 0 {
+		content += "\n\n#" + strings.Join(hashtags, " #")
 	}
 
 	if shouldUpgradeLinkSchema {
@@ -200,11 +305,14 @@ func ItemToTextNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, default
 		createdAt = *item.PublishedParsed
 	}
 
+	tags := append(mediaTags(media), hashtagTags(hashtags)...)
+	tags = append(tags, expirationTags(createdAt, settings)...)
+
 	evt := nostr.Event{
 		PubKey:    pubkey,
 		CreatedAt: createdAt,
 		Kind:      nostr.KindTextNote,
-		Tags:      nostr.Tags{},
+		Tags:      tags,
 		Content:   strings.ToValidUTF8(content, ""),
 	}
 	evt.ID = string(evt.Serialize())
@@ -219,10 +327,35 @@ func PrivateKeyFromFeed(url string, secret string) string {
 	return hex.EncodeToString(r)
 }
 
+// DeleteInvalidFeed deletes the feeds at url along with their events, items
+// and claims, in one transaction. Their WebSub subscriptions are left to the
+// caller, which unsubscribes them from their hubs.
 func DeleteInvalidFeed(url string, db *sql.DB) {
-	if _, err := db.Exec(`DELETE FROM feeds WHERE url=?`, url); err != nil {
+	if err := deleteFeeds(url, db); err != nil {
 		log.Printf("failure to delete invalid feed: " + err.Error())
 	} else {
 		log.Printf("deleted invalid feed with url %q", url)
 	}
 }
+
+func deleteFeeds(url string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		`DELETE FROM events WHERE pubkey IN (SELECT publickey FROM feeds WHERE url=?)`,
+		`DELETE FROM items WHERE publickey IN (SELECT publickey FROM feeds WHERE url=?)`,
+		`DELETE FROM feed_claims WHERE publickey IN (SELECT publickey FROM feeds WHERE url=?)`,
+	} {
+		if _, err := tx.Exec(statement, url); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM feeds WHERE url=?`, url); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -6,7 +6,10 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/mmcdole/gofeed"
 	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/piraces/rsslay/internal/testdb"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -89,7 +92,9 @@ var sampleDefaultFeedItem = gofeed.Item{
 }
 
 var sampleDefaultFeedItemExpectedContent = fmt.Sprintf("**%s**\n\n%s", sampleDefaultFeedItem.Title, sampleDefaultFeedItem.Description)
-var sampleDefaultFeedItemExpectedContentSubstring = sampleDefaultFeedItemExpectedContent[0:249]
+
+// Notes are truncated at the last word that fits in 250 characters
+var sampleDefaultFeedItemExpectedContentSubstring = sampleDefaultFeedItemExpectedContent[0:strings.LastIndex(sampleDefaultFeedItemExpectedContent[0:250], " ")]
 
 var sampleStackerNewsFeedItem = gofeed.Item{
 	Title:           "Zero Knowledge Proofs: An illustrated primer",
@@ -246,7 +251,7 @@ func TestItemToTextNote(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		event := ItemToTextNote(tc.pubKey, tc.item, tc.feed, tc.defaultCreatedAt, tc.originalUrl)
+		event := ItemToTextNote(tc.pubKey, tc.item, tc.feed, tc.defaultCreatedAt, tc.originalUrl, Settings{MaxNoteLength: 250})
 		assert.NotEmpty(t, event)
 		assert.Equal(t, tc.pubKey, event.PubKey)
 		assert.Equal(t, tc.defaultCreatedAt, event.CreatedAt)
@@ -264,9 +269,14 @@ func TestDeleteExistingInvalidFeed(t *testing.T) {
 	}
 	defer db.Close()
 
+	mock.ExpectBegin()
+	for _, table := range []string{"events", "items", "feed_claims"} {
+		mock.ExpectExec("DELETE FROM " + table).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
 	mock.ExpectExec("DELETE FROM feeds").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 	DeleteInvalidFeed(sampleUrlForPublicKey, db)
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
 func TestDeleteNonExistingInvalidFeed(t *testing.T) {
@@ -276,7 +286,85 @@ func TestDeleteNonExistingInvalidFeed(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectExec("DELETE FROM feeds").WillReturnError(errors.New(""))
-	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM events").WillReturnError(errors.New(""))
+	mock.ExpectRollback()
 	DeleteInvalidFeed(sampleUrlForPublicKey, db)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteInvalidFeedDeletesItsRows(t *testing.T) {
+	db := testdb.Open(t)
+	statements := []string{
+		`INSERT INTO feeds (publickey, privatekey, url) VALUES ('dead', 'sk', 'https://dead.example/rss'), ('alive', 'sk', 'https://alive.example/rss')`,
+		`INSERT INTO events (id, pubkey, kind, created_at, tags, content, sig) VALUES ('1', 'dead', 1, 0, '[]', '', ''), ('2', 'alive', 1, 0, '[]', '', '')`,
+		`INSERT INTO items (publickey, item_key, first_seen_at) VALUES ('dead', 'urn:1', 0), ('alive', 'urn:1', 0)`,
+		`INSERT INTO feed_claims (token, publickey, owner, created_at) VALUES ('t1', 'dead', 'owner', 0), ('t2', 'alive', 'owner', 0)`,
+	}
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		assert.NoError(t, err)
+	}
+
+	DeleteInvalidFeed("https://dead.example/rss", db)
+
+	for _, table := range []string{"feeds WHERE publickey", "events WHERE pubkey", "items WHERE publickey", "feed_claims WHERE publickey"} {
+		var dead, alive int
+		assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM `+table+`='dead'`).Scan(&dead))
+		assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM `+table+`='alive'`).Scan(&alive))
+		assert.Equal(t, 0, dead, table)
+		assert.Equal(t, 1, alive, table)
+	}
+}
+
+const sampleRssFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+<channel>
+<title>Sample feed</title>
+<link>https://sample.example</link>
+<description>A sample feed</description>
+<item>
+<title>First post</title>
+<link>https://sample.example/first</link>
+<guid>https://sample.example/first</guid>
+<pubDate>Mon, 06 Feb 2023 10:00:00 GMT</pubDate>
+</item>
+</channel>
+</rss>`
+
+func TestFetchFeedSendsValidatorsAndHandlesNotModified(t *testing.T) {
+	const etag = `"v1"`
+	const lastModified = "Mon, 06 Feb 2023 10:00:00 GMT"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag && r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write([]byte(sampleRssFeed))
+	}))
+	defer server.Close()
+
+	feed, validators, err := FetchFeed(server.URL, CacheValidators{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Sample feed", feed.Title)
+	assert.Len(t, feed.Items, 1)
+	assert.Equal(t, CacheValidators{ETag: etag, LastModified: lastModified}, validators)
+
+	feed, unchanged, err := FetchFeed(server.URL, validators)
+	assert.ErrorIs(t, err, ErrNotModified)
+	assert.Nil(t, feed)
+	assert.Equal(t, validators, unchanged)
+}
+
+func TestFetchFeedWithErrorStatusReturnsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	feed, _, err := FetchFeed(server.URL, CacheValidators{})
+	assert.Nil(t, feed)
+	assert.ErrorContains(t, err, "500")
 }
@@ -0,0 +1,57 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"strings"
+	"unicode"
+)
+
+// maxHashtagLength discards categories that are sentences rather than topics.
+const maxHashtagLength = 40
+
+// Hashtags returns the normalised categories of an item that can be used as
+// hashtags, without duplicates or the blocked ones, up to the configured number.
+func Hashtags(item *gofeed.Item, settings Settings) []string {
+	blocked := map[string]bool{}
+	for _, category := range settings.HashtagBlocklist {
+		blocked[NormaliseHashtag(category)] = true
+	}
+
+	var hashtags []string
+	for _, category := range item.Categories {
+		if len(hashtags) >= settings.MaxHashtags {
+			break
+		}
+		hashtag := NormaliseHashtag(category)
+		if hashtag == "" || blocked[hashtag] || len([]rune(hashtag)) > maxHashtagLength || isNumber(hashtag) {
+			continue
+		}
+		blocked[hashtag] = true
+		hashtags = append(hashtags, hashtag)
+	}
+	return hashtags
+}
+
+// NormaliseHashtag turns a category into a lowercase hashtag without the "#",
+// dropping the spaces and punctuation hashtags can't contain.
+func NormaliseHashtag(category string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, category)
+}
+
+func hashtagTags(hashtags []string) nostr.Tags {
+	tags := nostr.Tags{}
+	for _, hashtag := range hashtags {
+		tags = append(tags, nostr.Tag{"t", hashtag})
+	}
+	return tags
+}
+
+func isNumber(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) == -1
+}
@@ -0,0 +1,43 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHashtags(t *testing.T) {
+	item := &gofeed.Item{Categories: []string{"Go", "Web Development", "#Nostr", "Uncategorized", "go", "2023", "Café-Society", "privacy"}}
+
+	hashtags := Hashtags(item, Settings{MaxHashtags: 4, HashtagBlocklist: []string{"uncategorized"}})
+	assert.Equal(t, []string{"go", "webdevelopment", "nostr", "cafésociety"}, hashtags)
+
+	assert.Empty(t, Hashtags(item, Settings{MaxHashtags: 0}))
+}
+
+func TestItemToTextNoteWithHashtags(t *testing.T) {
+	item := &gofeed.Item{
+		Title:           "Release",
+		Description:     "A new version",
+		Link:            "https://blog.example/release",
+		Categories:      []string{"Go", "Releases"},
+		PublishedParsed: &sampleNow,
+	}
+	feed := &gofeed.Feed{Link: "https://blog.example"}
+
+	evt := ItemToTextNote(samplePubKey, item, feed, sampleNow, "https://blog.example/rss", Settings{MaxNoteLength: 250, MaxHashtags: 5})
+	assert.Equal(t, nostr.Tags{{"t", "go"}, {"t", "releases"}}, evt.Tags)
+	assert.Equal(t, "**Release**\n\nA new version\n\nhttps://blog.example/release", evt.Content)
+
+	evt = ItemToTextNote(samplePubKey, item, feed, sampleNow, "https://blog.example/rss", Settings{MaxNoteLength: 250, MaxHashtags: 5, AppendHashtags: true})
+	assert.Equal(t, "**Release**\n\nA new version\n\n#go #releases\n\nhttps://blog.example/release", evt.Content)
+}
+
+func TestOptionsSettingsFallBackToDefaults(t *testing.T) {
+	defaults := Settings{MaxNoteLength: 250, MaxHashtags: 5}
+	assert.Equal(t, defaults, Options{}.Settings(defaults))
+
+	none := 0
+	assert.Equal(t, Settings{MaxNoteLength: 500, MaxHashtags: 0}, Options{MaxNoteLength: 500, MaxHashtags: &none}.Settings(defaults))
+}
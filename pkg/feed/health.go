@@ -0,0 +1,106 @@
+package feed
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// HealthState tracks whether a feed can be fetched. Feeds go from healthy to
+// degraded, suspended and finally dead as consecutive failures pile up, and go
+// back to healthy on the first successful fetch.
+type HealthState string
+
+const (
+	HealthHealthy   HealthState = "healthy"
+	HealthDegraded  HealthState = "degraded"
+	HealthSuspended HealthState = "suspended"
+	HealthDead      HealthState = "dead"
+)
+
+// HealthThresholds configure when a failing feed changes its state.
+type HealthThresholds struct {
+	// DegradedAfter is the number of consecutive failures to become degraded.
+	DegradedAfter int
+	// SuspendedAfter is the number of consecutive failures to become suspended.
+	SuspendedAfter int
+	// DeadAfter is how long a suspended feed has to keep failing to become dead.
+	DeadAfter time.Duration
+}
+
+// Health is the stored health of a feed.
+type Health struct {
+	State               HealthState
+	ConsecutiveFailures int
+	LastError           string
+	LastSuccessAt       time.Time
+	FailingSince        time.Time
+}
+
+// RecordFetchSuccess marks the feed with the given url as healthy, reviving it
+// if it was failing.
+func RecordFetchSuccess(url string, db *sql.DB) {
+	if _, err := db.Exec(`UPDATE feeds SET health_state=?, consecutive_failures=0, last_error='', last_success_at=?, failing_since=0 WHERE url=?`,
+		HealthHealthy, time.Now().Unix(), url); err != nil {
+		log.Printf("failure to record fetch success: " + err.Error())
+	}
+}
+
+// RecordFetchFailure counts a failed fetch of the feed with the given url and
+// returns its new health.
+func RecordFetchFailure(url string, fetchErr error, thresholds HealthThresholds, db *sql.DB) (Health, error) {
+	health, err := GetHealth(url, db)
+	if err != nil {
+		return health, err
+	}
+
+	now := time.Now()
+	health.ConsecutiveFailures++
+	health.LastError = fetchErr.Error()
+	if health.FailingSince.IsZero() {
+		health.FailingSince = now
+	}
+	health.State = nextHealthState(health, now, thresholds)
+
+	if _, err := db.Exec(`UPDATE feeds SET health_state=?, consecutive_failures=?, last_error=?, failing_since=? WHERE url=?`,
+		health.State, health.ConsecutiveFailures, health.LastError, health.FailingSince.Unix(), url); err != nil {
+		return health, fmt.Errorf("failure to record fetch failure: %w", err)
+	}
+
+	if health.State != HealthHealthy {
+		log.Printf("feed with url %q is %s after %d consecutive failures: %s", url, health.State, health.ConsecutiveFailures, health.LastError)
+	}
+
+	return health, nil
+}
+
+// GetHealth returns the stored health of the feed with the given url.
+func GetHealth(url string, db *sql.DB) (Health, error) {
+	var health Health
+	var lastSuccessAt, failingSince int64
+	row := db.QueryRow(`SELECT health_state, consecutive_failures, last_error, last_success_at, failing_since FROM feeds WHERE url=?`, url)
+	if err := row.Scan(&health.State, &health.ConsecutiveFailures, &health.LastError, &lastSuccessAt, &failingSince); err != nil {
+		return health, fmt.Errorf("failure to retrieve health of feed %q: %w", url, err)
+	}
+	if lastSuccessAt > 0 {
+		health.LastSuccessAt = time.Unix(lastSuccessAt, 0)
+	}
+	if failingSince > 0 {
+		health.FailingSince = time.Unix(failingSince, 0)
+	}
+	return health, nil
+}
+
+func nextHealthState(health Health, now time.Time, thresholds HealthThresholds) HealthState {
+	switch {
+	case health.ConsecutiveFailures >= thresholds.SuspendedAfter && thresholds.DeadAfter > 0 && now.Sub(health.FailingSince) >= thresholds.DeadAfter:
+		return HealthDead
+	case health.ConsecutiveFailures >= thresholds.SuspendedAfter:
+		return HealthSuspended
+	case health.ConsecutiveFailures >= thresholds.DegradedAfter:
+		return HealthDegraded
+	default:
+		return HealthHealthy
+	}
+}
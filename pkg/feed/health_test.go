@@ -0,0 +1,34 @@
+package feed
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNextHealthState(t *testing.T) {
+	thresholds := HealthThresholds{DegradedAfter: 3, SuspendedAfter: 10, DeadAfter: 24 * time.Hour}
+	testCases := []struct {
+		name         string
+		failures     int
+		failingSince time.Duration
+		expected     HealthState
+	}{
+		{name: "single failure", failures: 1, failingSince: time.Minute, expected: HealthHealthy},
+		{name: "a few failures", failures: 3, failingSince: time.Hour, expected: HealthDegraded},
+		{name: "many failures", failures: 10, failingSince: time.Hour, expected: HealthSuspended},
+		{name: "many failures for long", failures: 10, failingSince: 25 * time.Hour, expected: HealthDead},
+		{name: "few failures for long", failures: 4, failingSince: 25 * time.Hour, expected: HealthDegraded},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			health := Health{ConsecutiveFailures: tc.failures, FailingSince: sampleNow.Add(-tc.failingSince)}
+			assert.Equal(t, tc.expected, nextHealthState(health, sampleNow, thresholds))
+		})
+	}
+}
+
+func TestNextHealthStateNeverDiesWithoutDeadAfter(t *testing.T) {
+	health := Health{ConsecutiveFailures: 100, FailingSince: sampleNow.Add(-365 * 24 * time.Hour)}
+	assert.Equal(t, HealthSuspended, nextHealthState(health, sampleNow, HealthThresholds{DegradedAfter: 3, SuspendedAfter: 10}))
+}
@@ -0,0 +1,94 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/atom"
+	"net/http"
+	"strings"
+)
+
+// Keys of gofeed.Feed.Custom where the WebSub links of a feed are kept.
+const (
+	customHub  = "hub"
+	customSelf = "self"
+)
+
+// atomTranslator keeps the WebSub links that the default translator drops.
+type atomTranslator struct {
+	gofeed.DefaultAtomTranslator
+}
+
+func (t *atomTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultAtomTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	atomFeed, ok := feed.(*atom.Feed)
+	if !ok {
+		return result, nil
+	}
+	for _, link := range atomFeed.Links {
+		setWebSubLink(result, link.Rel, link.Href)
+	}
+
+	return result, nil
+}
+
+func newParser() *gofeed.Parser {
+	parser := gofeed.NewParser()
+	parser.RSSTranslator = &rssTranslator{}
+	parser.AtomTranslator = &atomTranslator{}
+	return parser
+}
+
+// WebSubHub returns the hub advertised by a feed, if any, and the topic to
+// subscribe to on it, which defaults to the url the feed was fetched from.
+func WebSubHub(feed *gofeed.Feed, url string) (hub string, topic string) {
+	if feed == nil || feed.Custom == nil {
+		return "", url
+	}
+
+	topic = feed.Custom[customSelf]
+	if topic == "" {
+		topic = url
+	}
+	return feed.Custom[customHub], topic
+}
+
+func setWebSubLink(feed *gofeed.Feed, rel string, href string) {
+	if rel != customHub && rel != customSelf || href == "" {
+		return
+	}
+	if feed.Custom == nil {
+		feed.Custom = map[string]string{}
+	}
+	if _, ok := feed.Custom[rel]; !ok {
+		feed.Custom[rel] = strings.TrimSpace(href)
+	}
+}
+
+// setWebSubLinksFromHeader reads the hub and self links sent as HTTP Link
+// headers, which take precedence over the ones inside the feed.
+func setWebSubLinksFromHeader(feed *gofeed.Feed, header http.Header) {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			href := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, param := range parts[1:] {
+				key, val, found := strings.Cut(strings.TrimSpace(param), "=")
+				if !found || !strings.EqualFold(key, "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(val, `"`)) {
+					if rel == customHub || rel == customSelf {
+						if feed.Custom == nil {
+							feed.Custom = map[string]string{}
+						}
+						feed.Custom[rel] = href
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package feed
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const sampleAtomFeedWithHub = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<title>Sample atom feed</title>
+<link rel="hub" href="https://hub.example/"/>
+<link rel="self" href="https://sample.example/atom.xml"/>
+</feed>`
+
+const sampleRssFeedWithHub = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+<channel>
+<title>Sample feed</title>
+<atom:link rel="hub" href="https://hub.example/"/>
+<atom:link rel="self" href="https://sample.example/rss.xml"/>
+</channel>
+</rss>`
+
+func TestWebSubHubIsDiscoveredInFeeds(t *testing.T) {
+	testCases := []struct {
+		content       string
+		expectedTopic string
+	}{
+		{content: sampleAtomFeedWithHub, expectedTopic: "https://sample.example/atom.xml"},
+		{content: sampleRssFeedWithHub, expectedTopic: "https://sample.example/rss.xml"},
+		{content: sampleRssFeed, expectedTopic: "https://fetched.example"},
+	}
+	for _, tc := range testCases {
+		f, err := ParseContent(strings.NewReader(tc.content))
+		assert.NoError(t, err)
+		hub, topic := WebSubHub(f, "https://fetched.example")
+		if tc.content == sampleRssFeed {
+			assert.Empty(t, hub)
+		} else {
+			assert.Equal(t, "https://hub.example/", hub)
+		}
+		assert.Equal(t, tc.expectedTopic, topic)
+	}
+}
+
+func TestWebSubHubFromLinkHeaderTakesPrecedence(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `<https://header-hub.example/>; rel="hub", <https://sample.example/self>; rel="self"`)
+		_, _ = w.Write([]byte(sampleAtomFeedWithHub))
+	}))
+	defer server.Close()
+
+	f, _, err := FetchFeed(server.URL, CacheValidators{})
+	assert.NoError(t, err)
+	hub, topic := WebSubHub(f, server.URL)
+	assert.Equal(t, "https://header-hub.example/", hub)
+	assert.Equal(t, "https://sample.example/self", topic)
+}
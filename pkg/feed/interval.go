@@ -0,0 +1,178 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys of gofeed.Feed.Custom where the RSS publisher hints are kept, as the
+// universal feed type does not carry them.
+const (
+	customTTL       = "ttl"
+	customSkipHours = "skipHours"
+	customSkipDays  = "skipDays"
+)
+
+// maxIntervalSamples is the number of most recent items used to estimate how
+// often a feed publishes.
+const maxIntervalSamples = 10
+
+var updatePeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// rssTranslator keeps the RSS channel hints about update frequency and the
+// WebSub links that the default translator drops.
+type rssTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+func (t *rssTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	rssFeed, ok := feed.(*rss.Feed)
+	if !ok {
+		return result, nil
+	}
+	if result.Custom == nil {
+		result.Custom = map[string]string{}
+	}
+	if rssFeed.TTL != "" {
+		result.Custom[customTTL] = strings.TrimSpace(rssFeed.TTL)
+	}
+	if len(rssFeed.SkipHours) > 0 {
+		result.Custom[customSkipHours] = strings.Join(rssFeed.SkipHours, ",")
+	}
+	if len(rssFeed.SkipDays) > 0 {
+		result.Custom[customSkipDays] = strings.Join(rssFeed.SkipDays, ",")
+	}
+	for _, link := range rssFeed.Extensions["atom"]["link"] {
+		setWebSubLink(result, link.Attrs["rel"], link.Attrs["href"])
+	}
+
+	return result, nil
+}
+
+// PollInterval estimates how often a feed should be polled from the dates of its
+// most recent items, never more often than the publisher asks for with <ttl> or
+// sy:updatePeriod. Dormant feeds are backed off proportionally to the time since
+// their last item. The result is bounded between min and max, or zero when
+// nothing can be learned from the feed.
+func PollInterval(feed *gofeed.Feed, now time.Time, min time.Duration, max time.Duration) time.Duration {
+	var dates []time.Time
+	for _, item := range feed.Items {
+		if item.PublishedParsed != nil {
+			dates = append(dates, *item.PublishedParsed)
+		} else if item.UpdatedParsed != nil {
+			dates = append(dates, *item.UpdatedParsed)
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].After(dates[j])
+	})
+	if len(dates) > maxIntervalSamples {
+		dates = dates[:maxIntervalSamples]
+	}
+
+	var interval time.Duration
+	if len(dates) >= 2 {
+		// Poll twice per average publishing period to pick up items reasonably fast
+		interval = dates[0].Sub(dates[len(dates)-1]) / time.Duration(len(dates)-1) / 2
+	}
+	if len(dates) > 0 {
+		if dormant := now.Sub(dates[0]) / 4; dormant > interval {
+			interval = dormant
+		}
+	}
+
+	if hint := publisherInterval(feed); hint > interval {
+		interval = hint
+	}
+
+	if interval == 0 {
+		return 0
+	}
+	if interval < min {
+		interval = min
+	}
+	if interval > max {
+		interval = max
+	}
+
+	return interval
+}
+
+// NextPollAt returns the time after from plus interval that falls outside of the
+// hours and days the feed asks to skip with <skipHours> and <skipDays>.
+func NextPollAt(feed *gofeed.Feed, from time.Time, interval time.Duration) time.Time {
+	next := from.Add(interval)
+	if feed == nil || feed.Custom == nil {
+		return next
+	}
+
+	skipHours := map[int]bool{}
+	for _, hour := range strings.Split(feed.Custom[customSkipHours], ",") {
+		if h, err := strconv.Atoi(strings.TrimSpace(hour)); err == nil {
+			skipHours[h%24] = true
+		}
+	}
+	skipDays := map[string]bool{}
+	for _, day := range strings.Split(feed.Custom[customSkipDays], ",") {
+		if day = strings.TrimSpace(day); day != "" {
+			skipDays[strings.ToLower(day)] = true
+		}
+	}
+	if len(skipHours) == 24 || len(skipDays) == 7 {
+		return next
+	}
+
+	// Hints are expressed in GMT, move forward a whole hour at a time
+	for i := 0; i < 7*24; i++ {
+		utc := next.UTC()
+		if !skipHours[utc.Hour()] && !skipDays[strings.ToLower(utc.Weekday().String())] {
+			break
+		}
+		next = utc.Truncate(time.Hour).Add(time.Hour)
+	}
+
+	return next
+}
+
+func publisherInterval(feed *gofeed.Feed) time.Duration {
+	var interval time.Duration
+
+	if feed.Custom != nil {
+		if ttl, err := strconv.Atoi(feed.Custom[customTTL]); err == nil && ttl > 0 {
+			interval = time.Duration(ttl) * time.Minute
+		}
+	}
+
+	if sy, ok := feed.Extensions["sy"]; ok {
+		var period time.Duration
+		if values := sy["updatePeriod"]; len(values) > 0 {
+			period = updatePeriods[strings.ToLower(strings.TrimSpace(values[0].Value))]
+		}
+		frequency := 1
+		if values := sy["updateFrequency"]; len(values) > 0 {
+			if f, err := strconv.Atoi(strings.TrimSpace(values[0].Value)); err == nil && f > 0 {
+				frequency = f
+			}
+		}
+		if hint := period / time.Duration(frequency); hint > interval {
+			interval = hint
+		}
+	}
+
+	return interval
+}
@@ -0,0 +1,105 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var sampleNow = time.Date(2023, time.February, 6, 10, 0, 0, 0, time.UTC)
+
+func feedWithItemsEvery(every time.Duration, count int, lastAgo time.Duration) *gofeed.Feed {
+	var items []*gofeed.Item
+	for i := 0; i < count; i++ {
+		published := sampleNow.Add(-lastAgo - time.Duration(i)*every)
+		items = append(items, &gofeed.Item{PublishedParsed: &published})
+	}
+	return &gofeed.Feed{Items: items}
+}
+
+func TestPollInterval(t *testing.T) {
+	testCases := []struct {
+		name     string
+		feed     *gofeed.Feed
+		expected time.Duration
+	}{
+		{
+			name:     "publishes every two hours",
+			feed:     feedWithItemsEvery(2*time.Hour, 5, 10*time.Minute),
+			expected: time.Hour,
+		},
+		{
+			name:     "publishes more often than the minimum",
+			feed:     feedWithItemsEvery(time.Minute, 5, 0),
+			expected: 10 * time.Minute,
+		},
+		{
+			name:     "dormant for a year",
+			feed:     feedWithItemsEvery(time.Hour, 5, 365*24*time.Hour),
+			expected: 24 * time.Hour,
+		},
+		{
+			name:     "dormant for eight hours",
+			feed:     feedWithItemsEvery(time.Hour, 5, 8*time.Hour),
+			expected: 2 * time.Hour,
+		},
+		{
+			name:     "without dates",
+			feed:     &gofeed.Feed{Items: []*gofeed.Item{{Title: "undated"}}},
+			expected: 0,
+		},
+		{
+			name: "with ttl",
+			feed: func() *gofeed.Feed {
+				f := feedWithItemsEvery(time.Hour, 5, 0)
+				f.Custom = map[string]string{customTTL: "180"}
+				return f
+			}(),
+			expected: 3 * time.Hour,
+		},
+		{
+			name: "with syndication update period",
+			feed: func() *gofeed.Feed {
+				f := feedWithItemsEvery(time.Hour, 5, 0)
+				f.Extensions = ext.Extensions{"sy": {
+					"updatePeriod":    {{Value: "daily"}},
+					"updateFrequency": {{Value: "2"}},
+				}}
+				return f
+			}(),
+			expected: 12 * time.Hour,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, PollInterval(tc.feed, sampleNow, 10*time.Minute, 24*time.Hour))
+		})
+	}
+}
+
+func TestNextPollAtSkipsHoursAndDays(t *testing.T) {
+	// sampleNow is a Monday at 10:00 GMT
+	f := &gofeed.Feed{Custom: map[string]string{
+		customSkipHours: "11,12",
+		customSkipDays:  "Tuesday",
+	}}
+	assert.Equal(t, sampleNow.Add(3*time.Hour), NextPollAt(f, sampleNow, time.Hour))
+	assert.Equal(t, sampleNow.Add(38*time.Hour), NextPollAt(f, sampleNow, 20*time.Hour))
+	assert.Equal(t, sampleNow.Add(time.Hour), NextPollAt(nil, sampleNow, time.Hour))
+}
+
+func TestFetchFeedKeepsPublisherHints(t *testing.T) {
+	f, err := gofeed.NewParser().ParseString(sampleRssFeed)
+	assert.NoError(t, err)
+	assert.Empty(t, f.Custom)
+
+	parser := gofeed.NewParser()
+	parser.RSSTranslator = &rssTranslator{}
+	f, err = parser.ParseString(`<rss version="2.0"><channel><title>t</title><ttl>60</ttl><skipHours><hour>1</hour><hour>2</hour></skipHours><skipDays><day>Sunday</day></skipDays></channel></rss>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "60", f.Custom[customTTL])
+	assert.Equal(t, "1,2", f.Custom[customSkipHours])
+	assert.Equal(t, "Sunday", f.Custom[customSkipDays])
+}
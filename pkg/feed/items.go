@@ -0,0 +1,94 @@
+package feed
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"strings"
+	"time"
+)
+
+// ItemKey identifies an item within its feed: its GUID, its link when it has no
+// GUID, or a hash of its title and description when it has neither.
+func ItemKey(item *gofeed.Item) string {
+	if guid := strings.TrimSpace(item.GUID); guid != "" {
+		return guid
+	}
+	if link := strings.TrimSpace(item.Link); link != "" {
+		return link
+	}
+	hash := sha256.Sum256([]byte(item.Title + "\n" + item.Description))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// FirstSeen returns when the item of the feed with the given public key was
+// first seen, recording now if it is new. It is used as the date of items
+// without one, so they keep the same events on every poll.
+func FirstSeen(pubkey string, item *gofeed.Item, now time.Time, db *sql.DB) (time.Time, error) {
+	key := ItemKey(item)
+	if _, err := db.Exec(`INSERT OR IGNORE INTO items (publickey, item_key, first_seen_at) VALUES (?, ?, ?)`, pubkey, key, now.Unix()); err != nil {
+		return now, fmt.Errorf("failed to record item %q: %w", key, err)
+	}
+
+	var firstSeenAt int64
+	if err := db.QueryRow(`SELECT first_seen_at FROM items WHERE publickey=? AND item_key=?`, pubkey, key).Scan(&firstSeenAt); err != nil {
+		return now, fmt.Errorf("failed to retrieve item %q: %w", key, err)
+	}
+	return time.Unix(firstSeenAt, 0), nil
+}
+
+// RecordPresence records that the items of the feed with the given public key
+// were present in the feed now, to notice later when they are removed from it.
+// New items are first seen now minus their position, like in FirstSeen, so
+// undated ones keep the order of the feed.
+func RecordPresence(pubkey string, items []*gofeed.Item, now time.Time, db *sql.DB) error {
+	for i, item := range items {
+		key := ItemKey(item)
+		if _, err := db.Exec(`INSERT INTO items (publickey, item_key, first_seen_at, last_seen_at) VALUES (?, ?, ?, ?) ON CONFLICT (publickey, item_key) DO UPDATE SET last_seen_at=excluded.last_seen_at`,
+			pubkey, key, now.Add(-time.Duration(i)*time.Second).Unix(), now.Unix()); err != nil {
+			return fmt.Errorf("failed to record item %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// MissingItems returns the keys of the items of the feed with the given public
+// key that were not present in the feed fetched at polledAt, and have not been
+// seen for at least the grace period. Items already deleted are left out.
+func MissingItems(pubkey string, polledAt time.Time, grace time.Duration, db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT item_key FROM items WHERE publickey=? AND deleted_at=0 AND last_seen_at<? AND last_seen_at<=?`,
+		pubkey, polledAt.Unix(), polledAt.Add(-grace).Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve missing items: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan missing item: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// MarkDeleted records that the item of the feed with the given public key has
+// been deleted, so it is not published again if it comes back.
+func MarkDeleted(pubkey string, key string, now time.Time, db *sql.DB) error {
+	if _, err := db.Exec(`UPDATE items SET deleted_at=? WHERE publickey=? AND item_key=?`, now.Unix(), pubkey, key); err != nil {
+		return fmt.Errorf("failed to mark item %q as deleted: %w", key, err)
+	}
+	return nil
+}
+
+// IsDeleted reports whether the item of the feed with the given public key has
+// been deleted.
+func IsDeleted(pubkey string, item *gofeed.Item, db *sql.DB) bool {
+	var deletedAt int64
+	err := db.QueryRow(`SELECT deleted_at FROM items WHERE publickey=? AND item_key=?`, pubkey, ItemKey(item)).Scan(&deletedAt)
+	return err == nil && deletedAt > 0
+}
@@ -0,0 +1,106 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestItemKey(t *testing.T) {
+	assert.Equal(t, "urn:1", ItemKey(&gofeed.Item{GUID: " urn:1 ", Link: "https://blog.example/1"}))
+	assert.Equal(t, "https://blog.example/1", ItemKey(&gofeed.Item{Link: "https://blog.example/1"}))
+
+	untitled := ItemKey(&gofeed.Item{Title: "Title", Description: "Description"})
+	assert.Equal(t, untitled, ItemKey(&gofeed.Item{Title: "Title", Description: "Description"}))
+	assert.NotEqual(t, untitled, ItemKey(&gofeed.Item{Title: "Title", Description: "Other"}))
+}
+
+func TestFirstSeenIsStable(t *testing.T) {
+	db := testdb.Open(t)
+	item := &gofeed.Item{Title: "Undated", Link: "https://blog.example/undated"}
+	firstPoll := time.Unix(1675677600, 0)
+
+	firstSeen, err := FirstSeen(samplePubKey, item, firstPoll, db)
+	assert.NoError(t, err)
+	assert.Equal(t, firstPoll, firstSeen)
+
+	firstSeen, err = FirstSeen(samplePubKey, item, firstPoll.Add(time.Hour), db)
+	assert.NoError(t, err)
+	assert.Equal(t, firstPoll, firstSeen)
+
+	// The same item in another feed is a different one
+	firstSeen, err = FirstSeen("other", item, firstPoll.Add(time.Hour), db)
+	assert.NoError(t, err)
+	assert.Equal(t, firstPoll.Add(time.Hour), firstSeen)
+}
+
+func TestUndatedItemsKeepTheSameNote(t *testing.T) {
+	db := testdb.Open(t)
+	item := &gofeed.Item{Title: "Undated", Link: "https://blog.example/undated"}
+	parsedFeed := &gofeed.Feed{Items: []*gofeed.Item{item}}
+
+	var ids []string
+	for _, now := range []time.Time{sampleNow, sampleNow.Add(time.Hour)} {
+		firstSeen, err := FirstSeen(samplePubKey, item, now, db)
+		assert.NoError(t, err)
+		ids = append(ids, ItemToTextNote(samplePubKey, item, parsedFeed, firstSeen, "https://blog.example/rss", Settings{MaxNoteLength: 250}).ID)
+	}
+	assert.Equal(t, ids[0], ids[1])
+}
+
+func TestMissingItemsAfterGracePeriod(t *testing.T) {
+	db := testdb.Open(t)
+	kept := &gofeed.Item{GUID: "kept"}
+	removed := &gofeed.Item{GUID: "removed"}
+	firstPoll := time.Unix(1675677600, 0)
+	grace := 24 * time.Hour
+
+	assert.NoError(t, RecordPresence(samplePubKey, []*gofeed.Item{kept, removed}, firstPoll, db))
+
+	// Items present in the last poll are never missing
+	missing, err := MissingItems(samplePubKey, firstPoll, 0, db)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	secondPoll := firstPoll.Add(time.Hour)
+	assert.NoError(t, RecordPresence(samplePubKey, []*gofeed.Item{kept}, secondPoll, db))
+	missing, err = MissingItems(samplePubKey, secondPoll, grace, db)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	thirdPoll := firstPoll.Add(grace)
+	assert.NoError(t, RecordPresence(samplePubKey, []*gofeed.Item{kept}, thirdPoll, db))
+	missing, err = MissingItems(samplePubKey, thirdPoll, grace, db)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"removed"}, missing)
+
+	assert.NoError(t, MarkDeleted(samplePubKey, "removed", thirdPoll, db))
+	assert.True(t, IsDeleted(samplePubKey, removed, db))
+	assert.False(t, IsDeleted(samplePubKey, kept, db))
+	missing, err = MissingItems(samplePubKey, thirdPoll, grace, db)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// Recording presence keeps the first time items were seen, minus their
+	// position in the feed
+	firstSeen, err := FirstSeen(samplePubKey, kept, thirdPoll, db)
+	assert.NoError(t, err)
+	assert.Equal(t, firstPoll, firstSeen)
+	firstSeen, err = FirstSeen(samplePubKey, removed, thirdPoll, db)
+	assert.NoError(t, err)
+	assert.Equal(t, firstPoll.Add(-time.Second), firstSeen)
+}
+
+func TestItemDeletionReferencesNotesAndArticles(t *testing.T) {
+	note := nostr.Event{ID: "note-id", PubKey: samplePubKey, Kind: nostr.KindTextNote}
+	article := nostr.Event{ID: "article-id", PubKey: samplePubKey, Kind: KindArticle, Tags: nostr.Tags{{"d", "urn:1"}}}
+
+	deletion := ItemDeletion(samplePubKey, []nostr.Event{note, article}, sampleNow, "Removed from the feed")
+	assert.Equal(t, nostr.KindDeletion, deletion.Kind)
+	assert.Equal(t, sampleNow, deletion.CreatedAt)
+	assert.Equal(t, "Removed from the feed", deletion.Content)
+	assert.Equal(t, nostr.Tags{{"e", "note-id"}, {"e", "article-id"}, {"a", "30023:" + samplePubKey + ":urn:1"}}, deletion.Tags)
+}
@@ -0,0 +1,237 @@
+package feed
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keyring holds the secrets the keys of feeds are derived from, by version.
+// New feeds are created with the current version, and existing feeds keep the
+// version they were created with until their keys are rotated.
+type Keyring struct {
+	Current int
+	Secrets map[int]string
+	// Cipher encrypts the derived keys before they are stored, if any.
+	Cipher *KeyCipher
+}
+
+// NewKeyring builds a keyring from the current secret and its version, and the
+// previous secrets as "version:secret" pairs.
+func NewKeyring(secret string, version int, previous []string) (Keyring, error) {
+	if secret == "" {
+		return Keyring{}, errors.New("no secret to derive keys from")
+	}
+	if version <= 0 {
+		return Keyring{}, fmt.Errorf("invalid secret version %d", version)
+	}
+	keyring := Keyring{Current: version, Secrets: map[int]string{version: secret}}
+	for _, pair := range previous {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		versionPart, previousSecret, found := strings.Cut(pair, ":")
+		previousVersion, err := strconv.Atoi(versionPart)
+		if !found || err != nil || previousVersion <= 0 || previousSecret == "" {
+			return Keyring{}, fmt.Errorf("invalid previous secret, expected \"version:secret\"")
+		}
+		if _, ok := keyring.Secrets[previousVersion]; ok {
+			return Keyring{}, fmt.Errorf("secret version %d is configured twice", previousVersion)
+		}
+		keyring.Secrets[previousVersion] = previousSecret
+	}
+	return keyring, nil
+}
+
+// PrivateKey derives the private key of the feed at url with the secret of the
+// given version.
+func (k Keyring) PrivateKey(url string, version int) (string, error) {
+	secret, ok := k.Secrets[version]
+	if !ok {
+		return "", fmt.Errorf("no secret configured for version %d", version)
+	}
+	return PrivateKeyFromFeed(url, secret), nil
+}
+
+// verifyKey checks that the key of the feed at url was derived with the secret
+// of the given version, so keys are only rotated away from known secrets.
+func (k Keyring) verifyKey(url string, version int, pubkey string) error {
+	sk, err := k.PrivateKey(url, version)
+	if err != nil {
+		return fmt.Errorf("can't verify key of feed %q: %w", url, err)
+	}
+	if pk, err := nostr.GetPublicKey(sk); err != nil || pk != pubkey {
+		return fmt.Errorf("key of feed %q was not derived with the secret of version %d", url, version)
+	}
+	return nil
+}
+
+// KeySource tells where the key of a feed comes from. Only derived keys can be
+// rotated, as the others belong to the owners of the feeds.
+type KeySource string
+
+const (
+	// KeyDerived keys are derived from a secret and the url of the feed.
+	KeyDerived KeySource = "derived"
+	// KeyUploaded keys were uploaded by their owner and are stored like the
+	// derived ones.
+	KeyUploaded KeySource = "uploaded"
+	// KeyRemote keys stay in the NIP-46 bunker of their owner, which signs the
+	// events of the feed.
+	KeyRemote KeySource = "remote"
+)
+
+// ErrKeyInUse is returned when a key brought by its owner is already the key of
+// another feed.
+var ErrKeyInUse = errors.New("the key is already used by another feed")
+
+// ParseKeySource validates a key source, accepting empty ones as derived.
+func ParseKeySource(source string) (KeySource, error) {
+	switch KeySource(source) {
+	case "":
+		return KeyDerived, nil
+	case KeyDerived, KeyUploaded, KeyRemote:
+		return KeySource(source), nil
+	default:
+		return "", fmt.Errorf("unknown key source %q", source)
+	}
+}
+
+// KeyInUse tells whether a feed already has the given public key.
+func KeyInUse(pubkey string, db *sql.DB) (bool, error) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM feeds WHERE publickey=?`, pubkey).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look up key: %w", err)
+	}
+	return count > 0, nil
+}
+
+// KeyHeldByOwner tells whether the owner of the feed with the given public key
+// holds its key, having brought it or received it when claiming the feed, so
+// the profile of the key is theirs to manage.
+func KeyHeldByOwner(pubkey string, db *sql.DB) bool {
+	var held bool
+	if err := db.QueryRow(`SELECT owner<>'' AND delegation='' FROM feeds WHERE publickey=?`, pubkey).Scan(&held); err != nil {
+		return false
+	}
+	return held
+}
+
+// Bunker returns the connection URL of the bunker holding the key of the feed
+// with the given public key, or an empty string if the key is stored here.
+func Bunker(pubkey string, db *sql.DB) string {
+	var bunker string
+	if err := db.QueryRow(`SELECT bunker FROM feeds WHERE publickey=? AND key_source=?`, pubkey, KeyRemote).Scan(&bunker); err != nil {
+		return ""
+	}
+	return bunker
+}
+
+// KeyRotation is the planned rotation of the key of a single feed to another
+// secret version, which gives the feed a new identity.
+type KeyRotation struct {
+	URL           string `json:"url"`
+	OldPublicKey  string `json:"old_publickey"`
+	OldKeyVersion int    `json:"old_key_version"`
+	NewPublicKey  string `json:"new_publickey"`
+	NewKeyVersion int    `json:"new_key_version"`
+}
+
+// PlanKeyRotation returns the rotations moving the keys of the feeds derived
+// with the secret of version from, or of every version but the target one if
+// from is zero, to the target version. Feeds with keys brought by their owner
+// are left out, and so are claimed feeds, as their owners hold or delegated to
+// their current keys. The current key of every feed must match the one
+// derived with the configured secret of its version. Nothing is changed until
+// the plan is applied.
+func PlanKeyRotation(keyring Keyring, from int, to int, db *sql.DB) ([]KeyRotation, error) {
+	if _, ok := keyring.Secrets[to]; !ok {
+		return nil, fmt.Errorf("no secret configured for version %d", to)
+	}
+
+	rows, err := db.Query(`SELECT url, publickey, key_version FROM feeds WHERE key_source=? AND owner='' AND key_version<>? AND (?=0 OR key_version=?) ORDER BY url`, KeyDerived, to, from, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve feeds to rotate: %w", err)
+	}
+	defer rows.Close()
+
+	var plan []KeyRotation
+	for rows.Next() {
+		rotation := KeyRotation{NewKeyVersion: to}
+		if err := rows.Scan(&rotation.URL, &rotation.OldPublicKey, &rotation.OldKeyVersion); err != nil {
+			return nil, fmt.Errorf("failed to scan feed to rotate: %w", err)
+		}
+		if err := keyring.verifyKey(rotation.URL, rotation.OldKeyVersion, rotation.OldPublicKey); err != nil {
+			return nil, err
+		}
+		sk, _ := keyring.PrivateKey(rotation.URL, to)
+		if rotation.NewPublicKey, err = nostr.GetPublicKey(sk); err != nil {
+			return nil, fmt.Errorf("failed to derive key of feed %q: %w", rotation.URL, err)
+		}
+		plan = append(plan, rotation)
+	}
+	return plan, rows.Err()
+}
+
+// ApplyKeyRotation rotates the key of a feed as planned, moving its items to
+// the new identity and recording the rotation in the key_rotations table. The
+// feed must be unchanged since the plan was made, and the new key must be the
+// planned one. Events published under the old key are kept.
+func ApplyKeyRotation(keyring Keyring, rotation KeyRotation, now time.Time, db *sql.DB) error {
+	if err := keyring.verifyKey(rotation.URL, rotation.OldKeyVersion, rotation.OldPublicKey); err != nil {
+		return err
+	}
+	sk, err := keyring.PrivateKey(rotation.URL, rotation.NewKeyVersion)
+	if err != nil {
+		return err
+	}
+	if pk, err := nostr.GetPublicKey(sk); err != nil || pk != rotation.NewPublicKey {
+		return fmt.Errorf("the key derived for feed %q is not the planned one", rotation.URL)
+	}
+
+	stored, err := keyring.Cipher.Seal(rotation.NewPublicKey, sk)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The feed is fetched in full on the next poll, so the profile and notes
+	// are published again under the new key
+	res, err := tx.Exec(`UPDATE feeds SET publickey=?, privatekey=?, key_version=?, etag='', last_modified='', last_polled_at=0, next_poll_at=0 WHERE publickey=? AND url=? AND key_version=? AND key_source=? AND owner=''`,
+		rotation.NewPublicKey, stored, rotation.NewKeyVersion, rotation.OldPublicKey, rotation.URL, rotation.OldKeyVersion, KeyDerived)
+	if err != nil {
+		return fmt.Errorf("failed to rotate key of feed %q: %w", rotation.URL, err)
+	}
+	if updated, _ := res.RowsAffected(); updated == 0 {
+		return fmt.Errorf("feed %q changed since the plan was made", rotation.URL)
+	}
+
+	statements := []string{
+		`UPDATE items SET publickey=? WHERE publickey=?`,
+		// Subscriptions are made again for the new key on the next poll
+		`DELETE FROM websub_subscriptions WHERE publickey=? OR publickey=?`,
+		// Claims are made again for the new key
+		`DELETE FROM feed_claims WHERE publickey=? OR publickey=?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, rotation.NewPublicKey, rotation.OldPublicKey); err != nil {
+			return fmt.Errorf("failed to rotate key of feed %q: %w", rotation.URL, err)
+		}
+	}
+
+	if _, err := tx.Exec(`INSERT INTO key_rotations (url, old_publickey, old_key_version, new_publickey, new_key_version, rotated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		rotation.URL, rotation.OldPublicKey, rotation.OldKeyVersion, rotation.NewPublicKey, rotation.NewKeyVersion, now.Unix()); err != nil {
+		return fmt.Errorf("failed to record rotation of feed %q: %w", rotation.URL, err)
+	}
+
+	return tx.Commit()
+}
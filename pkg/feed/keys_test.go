@@ -0,0 +1,215 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewKeyring(t *testing.T) {
+	keyring, err := NewKeyring("new", 2, []string{"1:old", " "})
+	assert.NoError(t, err)
+	assert.Equal(t, Keyring{Current: 2, Secrets: map[int]string{1: "old", 2: "new"}}, keyring)
+
+	// Version 1 derives keys like before versions existed
+	sk, err := keyring.PrivateKey("https://blog.example/rss", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, PrivateKeyFromFeed("https://blog.example/rss", "old"), sk)
+	_, err = keyring.PrivateKey("https://blog.example/rss", 3)
+	assert.Error(t, err)
+
+	for _, previous := range [][]string{{"old"}, {"0:old"}, {"1:"}, {"2:again"}} {
+		_, err := NewKeyring("new", 2, previous)
+		assert.Error(t, err, previous)
+	}
+	_, err = NewKeyring("new", 0, nil)
+	assert.Error(t, err)
+	_, err = NewKeyring("", 1, nil)
+	assert.Error(t, err)
+}
+
+func TestKeyRotationIsPlannedThenApplied(t *testing.T) {
+	db := testdb.Open(t)
+	keyring, _ := NewKeyring("new", 2, []string{"1:leaked"})
+	insert := func(url string, version int) string {
+		sk, _ := keyring.PrivateKey(url, version)
+		pk, _ := nostr.GetPublicKey(sk)
+		_, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_version) VALUES (?, ?, ?, ?)`, pk, sk, url, version)
+		assert.NoError(t, err)
+		return pk
+	}
+	oldPublicKey := insert("https://old.example/rss", 1)
+	insert("https://new.example/rss", 2)
+	_, _ = db.Exec(`INSERT INTO items (publickey, item_key, first_seen_at) VALUES (?, 'urn:1', 1000)`, oldPublicKey)
+
+	plan, err := PlanKeyRotation(keyring, 1, 2, db)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 1)
+	assert.Equal(t, "https://old.example/rss", plan[0].URL)
+	assert.Equal(t, oldPublicKey, plan[0].OldPublicKey)
+	assert.Equal(t, 1, plan[0].OldKeyVersion)
+	assert.Equal(t, 2, plan[0].NewKeyVersion)
+	assert.NotEqual(t, oldPublicKey, plan[0].NewPublicKey)
+
+	_, err = PlanKeyRotation(keyring, 0, 3, db)
+	assert.Error(t, err)
+
+	// Plans not matching the derived key are refused
+	tampered := plan[0]
+	tampered.NewPublicKey = oldPublicKey
+	assert.Error(t, ApplyKeyRotation(keyring, tampered, sampleNow, db))
+
+	assert.NoError(t, ApplyKeyRotation(keyring, plan[0], sampleNow, db))
+	var version int
+	assert.NoError(t, db.QueryRow(`SELECT key_version FROM feeds WHERE publickey=?`, plan[0].NewPublicKey).Scan(&version))
+	assert.Equal(t, 2, version)
+	firstSeen, err := FirstSeen(plan[0].NewPublicKey, &gofeed.Item{GUID: "urn:1"}, sampleNow, db)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1000, 0), firstSeen)
+	var rotatedAt int64
+	assert.NoError(t, db.QueryRow(`SELECT rotated_at FROM key_rotations WHERE old_publickey=?`, oldPublicKey).Scan(&rotatedAt))
+	assert.Equal(t, sampleNow.Unix(), rotatedAt)
+
+	// Applying the same plan twice fails as the feed has changed
+	assert.Error(t, ApplyKeyRotation(keyring, plan[0], sampleNow, db))
+	plan, err = PlanKeyRotation(keyring, 0, 2, db)
+	assert.NoError(t, err)
+	assert.Empty(t, plan)
+}
+
+func TestRotatedFeedsArePolledAgainInFull(t *testing.T) {
+	const etag = `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(sampleRssFeed))
+	}))
+	defer server.Close()
+
+	db := testdb.Open(t)
+	keyring, _ := NewKeyring("new", 2, []string{"1:leaked"})
+	sk, _ := keyring.PrivateKey(server.URL, 1)
+	pk, _ := nostr.GetPublicKey(sk)
+	_, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_version, next_poll_at, last_polled_at) VALUES (?, ?, ?, 1, ?, ?)`,
+		pk, sk, server.URL, sampleNow.Add(time.Hour).Unix(), sampleNow.Unix())
+	assert.NoError(t, err)
+	parsedFeed, validators, err := FetchFeed(server.URL, GetCacheValidators(server.URL, db))
+	assert.NoError(t, err)
+	assert.NotNil(t, parsedFeed)
+	SaveCacheValidators(server.URL, validators, db)
+	_, _, err = FetchFeed(server.URL, GetCacheValidators(server.URL, db))
+	assert.ErrorIs(t, err, ErrNotModified)
+	owner, _ := nostr.GetPublicKey(sampleOwnerPrivateKey)
+	claim, err := StartClaim(pk, owner, sampleNow, db)
+	assert.NoError(t, err)
+
+	plan, err := PlanKeyRotation(keyring, 1, 2, db)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 1)
+	assert.NoError(t, ApplyKeyRotation(keyring, plan[0], sampleNow, db))
+
+	// The feed is due, and fetched in full to publish the profile of the new key
+	var nextPollAt, lastPolledAt int64
+	assert.NoError(t, db.QueryRow(`SELECT next_poll_at, last_polled_at FROM feeds WHERE publickey=?`, plan[0].NewPublicKey).Scan(&nextPollAt, &lastPolledAt))
+	assert.Zero(t, nextPollAt)
+	assert.Zero(t, lastPolledAt)
+	assert.Equal(t, CacheValidators{}, GetCacheValidators(server.URL, db))
+	parsedFeed, _, err = FetchFeed(server.URL, GetCacheValidators(server.URL, db))
+	assert.NoError(t, err)
+	metadata := FeedToSetMetadata(plan[0].NewPublicKey, parsedFeed, server.URL, false, "")
+	assert.Equal(t, plan[0].NewPublicKey, metadata.PubKey)
+	assert.Equal(t, nostr.KindSetMetadata, metadata.Kind)
+
+	// Claims of the old key can't be completed anymore
+	_, err = GetClaim(claim.Token, db)
+	assert.ErrorIs(t, err, ErrClaimNotFound)
+}
+
+func TestKeyRotationVerifiesTheOldKeys(t *testing.T) {
+	db := testdb.Open(t)
+	keyring, _ := NewKeyring("new", 2, []string{"1:leaked"})
+	sk, _ := keyring.PrivateKey("https://old.example/rss", 1)
+	pk, _ := nostr.GetPublicKey(sk)
+	_, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_version) VALUES (?, ?, ?, 1)`, pk, sk, "https://old.example/rss")
+	assert.NoError(t, err)
+	plan, err := PlanKeyRotation(keyring, 1, 2, db)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 1)
+
+	// Without the previous secret, or with another one, old keys can't be verified
+	for _, previous := range [][]string{nil, {"1:wrong"}} {
+		other, _ := NewKeyring("new", 2, previous)
+		_, err = PlanKeyRotation(other, 1, 2, db)
+		assert.Error(t, err, previous)
+		assert.Error(t, ApplyKeyRotation(other, plan[0], sampleNow, db), previous)
+	}
+}
+
+func TestKeysBroughtByOwnersAreNotRotated(t *testing.T) {
+	db := testdb.Open(t)
+	keyring, _ := NewKeyring("new", 2, []string{"1:leaked"})
+	bunker := "bunker://" + samplePubKey + "?relay=wss%3A%2F%2Frelay.example"
+	_, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_version, key_source, bunker, owner) VALUES (?, '', ?, 0, ?, ?, ?)`,
+		samplePubKey, "https://owned.example/rss", KeyRemote, bunker, samplePubKey)
+	assert.NoError(t, err)
+
+	plan, err := PlanKeyRotation(keyring, 0, 2, db)
+	assert.NoError(t, err)
+	assert.Empty(t, plan)
+
+	// Nor by plans made for them
+	sk, _ := keyring.PrivateKey("https://owned.example/rss", 2)
+	pk, _ := nostr.GetPublicKey(sk)
+	rotation := KeyRotation{URL: "https://owned.example/rss", OldPublicKey: samplePubKey, NewPublicKey: pk, NewKeyVersion: 2}
+	assert.Error(t, ApplyKeyRotation(keyring, rotation, sampleNow, db))
+
+	assert.True(t, KeyHeldByOwner(samplePubKey, db))
+	assert.Equal(t, bunker, Bunker(samplePubKey, db))
+	assert.Empty(t, Bunker(pk, db))
+	inUse, err := KeyInUse(samplePubKey, db)
+	assert.NoError(t, err)
+	assert.True(t, inUse)
+	inUse, _ = KeyInUse(pk, db)
+	assert.False(t, inUse)
+}
+
+func TestClaimedFeedsAreNotRotated(t *testing.T) {
+	db := testdb.Open(t)
+	keyring, _ := NewKeyring("new", 2, []string{"1:leaked"})
+	sk, _ := keyring.PrivateKey("https://claimed.example/rss", 1)
+	pk, _ := nostr.GetPublicKey(sk)
+	_, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_version) VALUES (?, ?, ?, 1)`, pk, sk, "https://claimed.example/rss")
+	assert.NoError(t, err)
+	plan, err := PlanKeyRotation(keyring, 1, 2, db)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 1)
+
+	assert.False(t, KeyHeldByOwner(pk, db))
+
+	owner, _ := nostr.GetPublicKey(sampleOwnerPrivateKey)
+	_, err = db.Exec(`UPDATE feeds SET owner=? WHERE publickey=?`, owner, pk)
+	assert.NoError(t, err)
+	assert.True(t, KeyHeldByOwner(pk, db))
+	assert.Error(t, ApplyKeyRotation(keyring, plan[0], sampleNow, db))
+	plan, err = PlanKeyRotation(keyring, 1, 2, db)
+	assert.NoError(t, err)
+	assert.Empty(t, plan)
+}
+
+func TestParseKeySource(t *testing.T) {
+	for value, expected := range map[string]KeySource{"": KeyDerived, "derived": KeyDerived, "uploaded": KeyUploaded, "remote": KeyRemote} {
+		source, err := ParseKeySource(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, source)
+	}
+	_, err := ParseKeySource("borrowed")
+	assert.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package feed
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+// StoredKey is the key of a new feed as it must be stored: its public key, its
+// private key, encrypted if there is a key encryption key, and the version of
+// the secret it was derived with, if any.
+type StoredKey struct {
+	PublicKey  string `json:"publickey"`
+	PrivateKey string `json:"privatekey"`
+	Version    int    `json:"version"`
+}
+
+// KeyStore creates and hands over the private keys of feeds, so the process
+// serving the web pages can do without the secrets when they are kept by a
+// bunker.
+type KeyStore interface {
+	// Derive returns the key of a new feed at url, derived with the current
+	// secret.
+	Derive(ctx context.Context, url string) (StoredKey, error)
+	// Seal returns the key of a new feed brought by its owner.
+	Seal(ctx context.Context, sk string) (StoredKey, error)
+	// Export returns the signed direct message handing the private key of the
+	// feed of a verified claim over to its owner.
+	Export(ctx context.Context, token string) (nostr.Event, error)
+}
+
+// LocalKeys is the KeyStore holding the secrets in this process.
+type LocalKeys struct {
+	Keyring *Keyring
+	DB      *sql.DB
+}
+
+func (k *LocalKeys) Derive(_ context.Context, url string) (StoredKey, error) {
+	sk, err := k.Keyring.PrivateKey(url, k.Keyring.Current)
+	if err != nil {
+		return StoredKey{}, err
+	}
+	key := StoredKey{Version: k.Keyring.Current}
+	if key.PublicKey, err = nostr.GetPublicKey(sk); err != nil {
+		return StoredKey{}, err
+	}
+	key.PrivateKey, err = k.Keyring.Cipher.Seal(key.PublicKey, sk)
+	return key, err
+}
+
+func (k *LocalKeys) Seal(_ context.Context, sk string) (StoredKey, error) {
+	pubkey, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return StoredKey{}, errors.New("invalid private key")
+	}
+	stored, err := k.Keyring.Cipher.Seal(pubkey, sk)
+	return StoredKey{PublicKey: pubkey, PrivateKey: stored}, err
+}
+
+// Export doesn't trust the verification of the claim in the database, which
+// the relay can write: it looks for the proof of the claim again, and checks
+// that the key of the feed was derived from its url.
+func (k *LocalKeys) Export(_ context.Context, token string) (nostr.Event, error) {
+	claim, err := GetClaim(token, k.DB)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	if claim.Completed() {
+		return nostr.Event{}, ErrClaimCompleted
+	}
+	if !claim.Verified() {
+		return nostr.Event{}, ErrClaimNotVerified
+	}
+
+	var version int
+	if err := k.DB.QueryRow(`SELECT key_version FROM feeds WHERE publickey=? AND key_source=?`, claim.PublicKey, KeyDerived).Scan(&version); err != nil {
+		return nostr.Event{}, fmt.Errorf("no derived key for %s", claim.PublicKey)
+	}
+	if err := k.Keyring.verifyKey(claim.URL, version, claim.PublicKey); err != nil {
+		return nostr.Event{}, err
+	}
+	if !HasProof(claim.URL, claim.Proof()) {
+		return nostr.Event{}, ErrProofNotFound
+	}
+
+	sk, err := StoredPrivateKey(claim.PublicKey, k.Keyring.Cipher, k.DB)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	message, err := KeyExport(claim, sk, time.Now())
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	return message, message.Sign(sk)
+}
+
+// CallFunc calls a method of a bunker, returning its result.
+type CallFunc func(ctx context.Context, method string, params ...string) (string, error)
+
+// Methods of the bunker serving a KeyStore.
+const (
+	methodDeriveKey = "rsslay_derive_key"
+	methodSealKey   = "rsslay_seal_key"
+	methodExportKey = "rsslay_export_key"
+)
+
+// RemoteKeys is the KeyStore of a bunker serving the methods of KeyStoreMethods.
+type RemoteKeys struct {
+	Call CallFunc
+}
+
+func (k *RemoteKeys) Derive(ctx context.Context, url string) (StoredKey, error) {
+	return k.storedKey(ctx, methodDeriveKey, url)
+}
+
+func (k *RemoteKeys) Seal(ctx context.Context, sk string) (StoredKey, error) {
+	return k.storedKey(ctx, methodSealKey, sk)
+}
+
+func (k *RemoteKeys) Export(ctx context.Context, token string) (nostr.Event, error) {
+	result, err := k.Call(ctx, methodExportKey, token)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	var message nostr.Event
+	if err := json.Unmarshal([]byte(result), &message); err != nil {
+		return nostr.Event{}, fmt.Errorf("invalid key export from the bunker: %w", err)
+	}
+	if ok, _ := message.CheckSignature(); !ok || message.ID != message.GetID() {
+		return nostr.Event{}, errors.New("the bunker returned an invalid key export")
+	}
+	return message, nil
+}
+
+func (k *RemoteKeys) storedKey(ctx context.Context, method string, param string) (StoredKey, error) {
+	result, err := k.Call(ctx, method, param)
+	if err != nil {
+		return StoredKey{}, err
+	}
+	var key StoredKey
+	if err := json.Unmarshal([]byte(result), &key); err != nil || key.PublicKey == "" {
+		return StoredKey{}, errors.New("invalid key from the bunker")
+	}
+	return key, nil
+}
+
+// KeyStoreMethods returns the bunker methods serving a KeyStore to RemoteKeys.
+func KeyStoreMethods(keys KeyStore) map[string]func(ctx context.Context, params []string) (string, error) {
+	single := func(f func(ctx context.Context, param string) (any, error)) func(ctx context.Context, params []string) (string, error) {
+		return func(ctx context.Context, params []string) (string, error) {
+			if len(params) != 1 {
+				return "", errors.New("expected a single parameter")
+			}
+			result, err := f(ctx, params[0])
+			if err != nil {
+				return "", err
+			}
+			encoded, err := json.Marshal(result)
+			return string(encoded), err
+		}
+	}
+	return map[string]func(ctx context.Context, params []string) (string, error){
+		methodDeriveKey: single(func(ctx context.Context, url string) (any, error) { return keys.Derive(ctx, url) }),
+		methodSealKey:   single(func(ctx context.Context, sk string) (any, error) { return keys.Seal(ctx, sk) }),
+		methodExportKey: single(func(ctx context.Context, token string) (any, error) { return keys.Export(ctx, token) }),
+	}
+}
@@ -0,0 +1,103 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// remoteLocalKeys returns RemoteKeys calling the methods served for local keys,
+// like a bunker would.
+func remoteLocalKeys(local *LocalKeys) *RemoteKeys {
+	methods := KeyStoreMethods(local)
+	return &RemoteKeys{Call: func(ctx context.Context, method string, params ...string) (string, error) {
+		if serve, ok := methods[method]; ok {
+			return serve(ctx, params)
+		}
+		return "", errors.New("unsupported method " + method)
+	}}
+}
+
+func TestRemoteKeysAreDerivedAndSealedByTheBunker(t *testing.T) {
+	keyring, _ := NewKeyring("secret", 2, nil)
+	keyring.Cipher, _ = NewKeyCipher(sampleKeyEncryptionKey)
+	keys := remoteLocalKeys(&LocalKeys{Keyring: &keyring, DB: testdb.Open(t)})
+
+	key, err := keys.Derive(context.Background(), "https://blog.example/rss")
+	assert.NoError(t, err)
+	sk, _ := keyring.PrivateKey("https://blog.example/rss", 2)
+	pk, _ := nostr.GetPublicKey(sk)
+	assert.Equal(t, pk, key.PublicKey)
+	assert.Equal(t, 2, key.Version)
+	opened, err := keyring.Cipher.Open(pk, key.PrivateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, sk, opened)
+
+	key, err = keys.Seal(context.Background(), samplePrivateKeyForPubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, key.PublicKey)
+	assert.Zero(t, key.Version)
+	assert.True(t, IsEncryptedKey(key.PrivateKey))
+	_, err = keys.Seal(context.Background(), "not a key")
+	assert.Error(t, err)
+}
+
+func TestRemoteKeysAreExportedOnlyForVerifiedClaims(t *testing.T) {
+	db := testdb.Open(t)
+	keyring, _ := NewKeyring("secret", 1, nil)
+	keys := remoteLocalKeys(&LocalKeys{Keyring: &keyring, DB: db})
+	proof := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>Blog</title><description>` + proof + `</description></channel></rss>`))
+	}))
+	defer server.Close()
+
+	feedUrl := server.URL + "/feed.xml"
+	key, _ := (&LocalKeys{Keyring: &keyring}).Derive(context.Background(), feedUrl)
+	_, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, key_version) VALUES (?, ?, ?, ?)`, key.PublicKey, key.PrivateKey, feedUrl, key.Version)
+	assert.NoError(t, err)
+	owner, _ := nostr.GetPublicKey(sampleOwnerPrivateKey)
+	claim, err := StartClaim(key.PublicKey, owner, sampleNow, db)
+	assert.NoError(t, err)
+
+	_, err = keys.Export(context.Background(), claim.Token)
+	assert.ErrorContains(t, err, ErrClaimNotVerified.Error())
+	_, err = keys.Export(context.Background(), "unknown")
+	assert.ErrorContains(t, err, ErrClaimNotFound.Error())
+
+	// Claims marked as verified without the proof in the feed are refused
+	_, err = db.Exec(`UPDATE feed_claims SET verified_at=? WHERE token=?`, sampleNow.Unix(), claim.Token)
+	assert.NoError(t, err)
+	_, err = keys.Export(context.Background(), claim.Token)
+	assert.ErrorContains(t, err, ErrProofNotFound.Error())
+
+	proof = claim.Proof()
+	message, err := keys.Export(context.Background(), claim.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey, message.PubKey)
+	assert.Equal(t, nostr.KindEncryptedDirectMessage, message.Kind)
+	ok, _ := message.CheckSignature()
+	assert.True(t, ok)
+
+	// Nor are feeds moved to another url, where someone else may place the proof
+	_, err = db.Exec(`UPDATE feeds SET url=? WHERE publickey=?`, server.URL+"/feed.xml?moved", key.PublicKey)
+	assert.NoError(t, err)
+	_, err = keys.Export(context.Background(), claim.Token)
+	assert.Error(t, err)
+	_, err = db.Exec(`UPDATE feeds SET url=? WHERE publickey=?`, feedUrl, key.PublicKey)
+	assert.NoError(t, err)
+
+	claim, _ = GetClaim(claim.Token, db)
+	assert.NoError(t, CompleteClaim(claim, HandoverExport, "", sampleNow, db))
+	_, err = keys.Export(context.Background(), claim.Token)
+	assert.ErrorContains(t, err, ErrClaimCompleted.Error())
+}
@@ -0,0 +1,356 @@
+package feed
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	whitespace     = regexp.MustCompile(`\s+`)
+	trailingSpaces = regexp.MustCompile(`[ \t]+\n`)
+	blankLines     = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToMarkdown converts the HTML body of an item into Markdown, keeping its
+// paragraphs, headings, links, images, lists, quotes and code blocks. Relative
+// links are resolved against baseUrl, usually the link of the item.
+func HTMLToMarkdown(content string, baseUrl string) string {
+	return convert(content, baseUrl, false)
+}
+
+// HTMLToText converts the HTML body of an item into the text of a note, which
+// most clients don't render as Markdown. Paragraphs, lists and quotes are kept,
+// but links become inline URLs and images and media are left as URLs on their
+// own lines, so clients show them embedded.
+func HTMLToText(content string, baseUrl string) string {
+	return convert(content, baseUrl, true)
+}
+
+func convert(content string, baseUrl string, plain bool) string {
+	nodes, err := html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return ""
+	}
+
+	base, _ := url.Parse(baseUrl)
+	c := &markdownConverter{base: base, plain: plain}
+	w := &markdownWriter{}
+	for _, n := range nodes {
+		c.render(n, w)
+	}
+	return w.String()
+}
+
+// markdownConverter renders HTML nodes as Markdown, or as plain text with
+// inline URLs for notes.
+type markdownConverter struct {
+	base  *url.URL
+	plain bool
+}
+
+// markdownWriter accumulates Markdown, collapsing the whitespace of text the
+// way browsers do and keeping track of where lines and blocks start.
+type markdownWriter struct {
+	sb strings.Builder
+}
+
+func (w *markdownWriter) text(s string) {
+	s = whitespace.ReplaceAllString(s, " ")
+	if w.atLineStart() || strings.HasSuffix(w.sb.String(), " ") {
+		s = strings.TrimLeft(s, " ")
+	}
+	w.sb.WriteString(s)
+}
+
+func (w *markdownWriter) raw(s string) {
+	w.sb.WriteString(s)
+}
+
+func (w *markdownWriter) newline() {
+	if w.sb.Len() > 0 && !strings.HasSuffix(w.sb.String(), "\n") {
+		w.sb.WriteString("\n")
+	}
+}
+
+func (w *markdownWriter) block() {
+	if w.sb.Len() == 0 {
+		return
+	}
+	w.newline()
+	if !strings.HasSuffix(w.sb.String(), "\n\n") {
+		w.sb.WriteString("\n")
+	}
+}
+
+func (w *markdownWriter) atLineStart() bool {
+	return w.sb.Len() == 0 || strings.HasSuffix(w.sb.String(), "\n")
+}
+
+func (w *markdownWriter) String() string {
+	s := trailingSpaces.ReplaceAllString(w.sb.String(), "\n")
+	s = blankLines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
+
+func (c *markdownConverter) render(n *html.Node, w *markdownWriter) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		c.renderChildren(n, w)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Noscript, atom.Template, atom.Head, atom.Button, atom.Form:
+		// Not content
+	case atom.Br:
+		w.raw("\n")
+	case atom.Hr:
+		w.block()
+		w.raw("---")
+		w.block()
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level, _ := strconv.Atoi(n.Data[1:])
+		if heading := c.inline(n); heading != "" {
+			w.block()
+			if !c.plain {
+				w.raw(strings.Repeat("#", level) + " ")
+			}
+			w.raw(heading)
+			w.block()
+		}
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Aside, atom.Main, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd, atom.Table:
+		w.block()
+		c.renderChildren(n, w)
+		w.block()
+	case atom.Tr:
+		w.newline()
+		var cells []string
+		for cell := n.FirstChild; cell != nil; cell = cell.NextSibling {
+			if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+				cells = append(cells, c.inline(cell))
+			}
+		}
+		w.raw(strings.Join(cells, " | "))
+		w.newline()
+	case atom.Blockquote:
+		quote := c.nested(n)
+		if quote == "" {
+			return
+		}
+		w.block()
+		for _, line := range strings.Split(quote, "\n") {
+			w.raw(strings.TrimRight("> "+line, " ") + "\n")
+		}
+		w.block()
+	case atom.Ul, atom.Ol:
+		c.renderList(n, w)
+	case atom.Pre:
+		code := strings.Trim(textContent(n), "\n")
+		if code == "" {
+			return
+		}
+		w.block()
+		if c.plain {
+			w.raw(code)
+		} else {
+			w.raw("```\n" + code + "\n```")
+		}
+		w.block()
+	case atom.Code, atom.Kbd, atom.Samp:
+		if c.plain {
+			c.renderChildren(n, w)
+		} else if code := strings.TrimSpace(textContent(n)); code != "" {
+			w.raw("`" + code + "`")
+		}
+	case atom.Strong, atom.B:
+		c.renderWrapped(n, w, "**")
+	case atom.Em, atom.I:
+		c.renderWrapped(n, w, "*")
+	case atom.Del, atom.S, atom.Strike:
+		c.renderWrapped(n, w, "~~")
+	case atom.A:
+		c.renderLink(n, w)
+	case atom.Img:
+		src := c.resolve(attr(n, "src"))
+		if src == "" || isTrackingPixel(n) {
+			return
+		}
+		if c.plain {
+			w.newline()
+			w.raw(src)
+			w.newline()
+		} else {
+			w.raw("![" + strings.TrimSpace(attr(n, "alt")) + "](" + src + ")")
+		}
+	case atom.Video, atom.Audio, atom.Iframe:
+		src := attr(n, "src")
+		for child := n.FirstChild; child != nil && src == ""; child = child.NextSibling {
+			if child.DataAtom == atom.Source {
+				src = attr(child, "src")
+			}
+		}
+		if src = c.resolve(src); src != "" {
+			w.block()
+			w.raw(src)
+			w.block()
+		}
+	default:
+		c.renderChildren(n, w)
+	}
+}
+
+func (c *markdownConverter) renderChildren(n *html.Node, w *markdownWriter) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.render(child, w)
+	}
+}
+
+func (c *markdownConverter) renderWrapped(n *html.Node, w *markdownWriter, marker string) {
+	if c.plain {
+		c.renderChildren(n, w)
+	} else if inner := c.inline(n); inner != "" {
+		c.surround(n, w, marker+inner+marker)
+	}
+}
+
+// surround writes the rendering of an inline node keeping the whitespace around
+// its text, which is lost when rendering it as a single line.
+func (c *markdownConverter) surround(n *html.Node, w *markdownWriter, rendered string) {
+	text := textContent(n)
+	if strings.TrimLeftFunc(text, unicode.IsSpace) != text {
+		w.text(" ")
+	}
+	w.raw(rendered)
+	if strings.TrimRightFunc(text, unicode.IsSpace) != text {
+		w.text(" ")
+	}
+}
+
+func (c *markdownConverter) renderLink(n *html.Node, w *markdownWriter) {
+	// Images are already shown on their own, the page they link to is left out
+	if c.plain && strings.TrimSpace(textContent(n)) == "" {
+		c.renderChildren(n, w)
+		return
+	}
+
+	text := c.inline(n)
+	href := attr(n, "href")
+	if strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		href = ""
+	}
+	href = c.resolve(href)
+
+	switch {
+	case href == "":
+		w.text(text)
+	case c.plain && strings.HasPrefix(text, "#") && !strings.Contains(text, " "):
+		// Hashtags link to the tag on the site they come from
+		c.surround(n, w, text)
+	case text == "" || text == href || c.plain && isURLText(text, href):
+		c.surround(n, w, href)
+	case c.plain:
+		c.surround(n, w, text+" "+href)
+	default:
+		c.surround(n, w, "["+text+"]("+href+")")
+	}
+}
+
+func (c *markdownConverter) renderList(n *html.Node, w *markdownWriter) {
+	w.block()
+	index := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		index = start
+	}
+	for item := n.FirstChild; item != nil; item = item.NextSibling {
+		if item.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(index) + ". "
+			index++
+		}
+
+		w.newline()
+		lines := strings.Split(c.nested(item), "\n")
+		w.raw(marker + lines[0])
+		indent := strings.Repeat(" ", len(marker))
+		for _, line := range lines[1:] {
+			w.raw("\n")
+			if line != "" {
+				w.raw(indent + line)
+			}
+		}
+	}
+	w.block()
+}
+
+// inline renders the children of a node on a single line.
+func (c *markdownConverter) inline(n *html.Node) string {
+	return strings.TrimSpace(whitespace.ReplaceAllString(c.nested(n), " "))
+}
+
+// nested renders the children of a node on their own, to be indented or
+// prefixed by the caller.
+func (c *markdownConverter) nested(n *html.Node) string {
+	inner := &markdownWriter{}
+	c.renderChildren(n, inner)
+	return inner.String()
+}
+
+func (c *markdownConverter) resolve(href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "data:") {
+		return ""
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	if c.base != nil {
+		u = c.base.ResolveReference(u)
+	}
+	return u.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		sb.WriteString(textContent(child))
+	}
+	return sb.String()
+}
+
+// isURLText reports whether the text of a link is just its url, maybe without
+// the scheme or shortened.
+func isURLText(text string, href string) bool {
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "…"), "...")
+	return strings.ContainsAny(text, "./") && !strings.ContainsAny(text, " ") && strings.Contains(href, text)
+}
+
+// isTrackingPixel reports whether an image is one of the invisible images added
+// to feeds to count readers.
+func isTrackingPixel(n *html.Node) bool {
+	return attr(n, "width") == "1" && attr(n, "height") == "1"
+}
@@ -0,0 +1,80 @@
+package feed
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the tests")
+
+func TestHTMLToMarkdown(t *testing.T) {
+	testCases := []struct {
+		name     string
+		html     string
+		expected string
+	}{
+		{
+			name:     "paragraphs",
+			html:     "<p>First  paragraph\nwrapped.</p><p>Second</p>",
+			expected: "First paragraph wrapped.\n\nSecond",
+		},
+		{
+			name:     "headings and emphasis",
+			html:     "<h2>Title</h2><p>Some <strong>bold</strong> and <em>italic </em>text</p>",
+			expected: "## Title\n\nSome **bold** and *italic* text",
+		},
+		{
+			name:     "relative links and images",
+			html:     `<p>Read <a href="/more">more</a> or <a href="https://other.example">https://other.example</a></p><img src="img/a.png" alt="A">`,
+			expected: "Read [more](https://blog.example/more) or https://other.example\n\n![A](https://blog.example/posts/img/a.png)",
+		},
+		{
+			name:     "lists",
+			html:     "<ul><li>one</li><li>two<ol><li>nested</li></ol></li></ul>",
+			expected: "- one\n- two\n\n  1. nested",
+		},
+		{
+			name:     "quotes and code",
+			html:     "<blockquote><p>Quoted</p><p>twice</p></blockquote><pre><code>func main() {\n\treturn\n}</code></pre>",
+			expected: "> Quoted\n>\n> twice\n\n```\nfunc main() {\n\treturn\n}\n```",
+		},
+		{
+			name:     "scripts and tracking pixels",
+			html:     `<p>Text<script>alert(1)</script><style>p{}</style></p><img src="https://t.example/p.gif" width="1" height="1">`,
+			expected: "Text",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, HTMLToMarkdown(tc.html, "https://blog.example/posts/1"))
+		})
+	}
+}
+
+// TestHTMLToTextGolden converts the real-world item bodies in testdata/html and
+// compares them with the expected notes, which are rewritten with -update.
+func TestHTMLToTextGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "html", "*.html"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, inputs)
+
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			content, err := os.ReadFile(input)
+			assert.NoError(t, err)
+			actual := HTMLToText(string(content), "https://blog.example/posts/1")
+
+			golden := strings.TrimSuffix(input, ".html") + ".txt"
+			if *update {
+				assert.NoError(t, os.WriteFile(golden, []byte(actual+"\n"), 0644))
+			}
+			expected, err := os.ReadFile(golden)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.TrimSuffix(string(expected), "\n"), actual)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package feed
+
+import (
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/nbd-wtf/go-nostr"
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// mediaTypes are the types of the usual media extensions, which are not all
+// known by the mime package unless the system has a list of them.
+var mediaTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/opus",
+	".wav":  "audio/wav",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// Media is an attachment of an item, such as a podcast episode or an image.
+type Media struct {
+	URL      string
+	MimeType string
+	Size     int64
+	Width    int
+	Height   int
+	Alt      string
+}
+
+// IsImage reports whether the media is an image.
+func (m Media) IsImage() bool {
+	return strings.HasPrefix(m.MimeType, "image/")
+}
+
+// Tag returns the NIP-92 "imeta" tag describing the media.
+func (m Media) Tag() nostr.Tag {
+	tag := nostr.Tag{"imeta", "url " + m.URL}
+	if m.MimeType != "" {
+		tag = append(tag, "m "+m.MimeType)
+	}
+	if m.Size > 0 {
+		tag = append(tag, "size "+strconv.FormatInt(m.Size, 10))
+	}
+	if m.Width > 0 && m.Height > 0 {
+		tag = append(tag, "dim "+strconv.Itoa(m.Width)+"x"+strconv.Itoa(m.Height))
+	}
+	if m.Alt != "" {
+		tag = append(tag, "alt "+m.Alt)
+	}
+	return tag
+}
+
+// ItemMedia returns the attachments of an item from its enclosures, its Media
+// RSS content and thumbnails, and its image, without duplicates.
+func ItemMedia(item *gofeed.Item) []Media {
+	var media []Media
+	seen := map[string]int{}
+	add := func(m Media) {
+		m.URL = strings.TrimSpace(m.URL)
+		if m.URL == "" {
+			return
+		}
+		if m.MimeType == "" {
+			m.MimeType = mimeTypeFromURL(m.URL)
+		}
+		if i, ok := seen[m.URL]; ok {
+			media[i] = merge(media[i], m)
+			return
+		}
+		seen[m.URL] = len(media)
+		media = append(media, m)
+	}
+
+	for _, enclosure := range item.Enclosures {
+		size, _ := strconv.ParseInt(enclosure.Length, 10, 64)
+		add(Media{URL: enclosure.URL, MimeType: enclosure.Type, Size: size})
+	}
+
+	if extensions, ok := item.Extensions["media"]; ok {
+		contents := extensions["content"]
+		thumbnails := extensions["thumbnail"]
+		for _, group := range extensions["group"] {
+			contents = append(contents, group.Children["content"]...)
+			thumbnails = append(thumbnails, group.Children["thumbnail"]...)
+		}
+		for _, content := range contents {
+			add(mediaContent(content))
+		}
+		for _, thumbnail := range thumbnails {
+			m := mediaContent(thumbnail)
+			if m.MimeType == "" {
+				m.MimeType = "image/jpeg"
+			}
+			add(m)
+		}
+	}
+
+	if item.Image != nil {
+		add(Media{URL: item.Image.URL, Alt: strings.TrimSpace(item.Image.Title)})
+	}
+
+	return media
+}
+
+func mediaContent(e ext.Extension) Media {
+	m := Media{
+		URL:      e.Attrs["url"],
+		MimeType: e.Attrs["type"],
+	}
+	m.Size, _ = strconv.ParseInt(e.Attrs["fileSize"], 10, 64)
+	m.Width, _ = strconv.Atoi(e.Attrs["width"])
+	m.Height, _ = strconv.Atoi(e.Attrs["height"])
+	for _, key := range []string{"description", "title"} {
+		if values := e.Children[key]; len(values) > 0 && strings.TrimSpace(values[0].Value) != "" {
+			m.Alt = strings.TrimSpace(values[0].Value)
+			break
+		}
+	}
+	return m
+}
+
+// merge completes the details of a media with the ones of a duplicate.
+func merge(m Media, other Media) Media {
+	if m.MimeType == "" {
+		m.MimeType = other.MimeType
+	}
+	if m.Size == 0 {
+		m.Size = other.Size
+	}
+	if m.Width == 0 || m.Height == 0 {
+		m.Width, m.Height = other.Width, other.Height
+	}
+	if m.Alt == "" {
+		m.Alt = other.Alt
+	}
+	return m
+}
+
+func mimeTypeFromURL(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	extension := strings.ToLower(path.Ext(u.Path))
+	if mimeType, ok := mediaTypes[extension]; ok {
+		return mimeType
+	}
+	mimeType := mime.TypeByExtension(extension)
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
+	}
+	return ""
+}
+
+func mediaTags(media []Media) nostr.Tags {
+	tags := nostr.Tags{}
+	for _, m := range media {
+		tags = append(tags, m.Tag())
+	}
+	return tags
+}
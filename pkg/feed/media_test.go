@@ -0,0 +1,53 @@
+package feed
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const samplePodcastFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/">
+<channel>
+<title>Sample podcast</title>
+<link>https://podcast.example</link>
+<item>
+<title>Episode 1</title>
+<description>The first episode</description>
+<link>https://podcast.example/1</link>
+<pubDate>Mon, 06 Feb 2023 10:00:00 GMT</pubDate>
+<enclosure url="https://cdn.podcast.example/1.mp3" length="24986239" type="audio/mpeg"/>
+<media:content url="https://cdn.podcast.example/1.mp3" medium="audio"/>
+<media:group>
+<media:content url="https://cdn.podcast.example/cover.png" medium="image" width="1400" height="1400">
+<media:description>Episode cover</media:description>
+</media:content>
+</media:group>
+<media:thumbnail url="https://cdn.podcast.example/thumb?id=1" width="320" height="180"/>
+</item>
+</channel>
+</rss>`
+
+func TestItemMedia(t *testing.T) {
+	parsedFeed, err := ParseContent(strings.NewReader(samplePodcastFeed))
+	assert.NoError(t, err)
+
+	media := ItemMedia(parsedFeed.Items[0])
+	assert.Equal(t, []Media{
+		{URL: "https://cdn.podcast.example/1.mp3", MimeType: "audio/mpeg", Size: 24986239},
+		{URL: "https://cdn.podcast.example/cover.png", MimeType: "image/png", Width: 1400, Height: 1400, Alt: "Episode cover"},
+		{URL: "https://cdn.podcast.example/thumb?id=1", MimeType: "image/jpeg", Width: 320, Height: 180},
+	}, media)
+	assert.Equal(t, nostr.Tag{"imeta", "url https://cdn.podcast.example/cover.png", "m image/png", "dim 1400x1400", "alt Episode cover"}, media[1].Tag())
+}
+
+func TestItemToTextNoteWithMedia(t *testing.T) {
+	parsedFeed, err := ParseContent(strings.NewReader(samplePodcastFeed))
+	assert.NoError(t, err)
+
+	evt := ItemToTextNote(samplePubKey, parsedFeed.Items[0], parsedFeed, sampleNow, "https://podcast.example/rss", Settings{MaxNoteLength: 250})
+	assert.Equal(t, "**Episode 1**\n\nThe first episode\n\nhttps://cdn.podcast.example/1.mp3\n\nhttps://cdn.podcast.example/cover.png\n\nhttps://cdn.podcast.example/thumb?id=1\n\nhttps://podcast.example/1", evt.Content)
+	assert.Len(t, evt.Tags, 3)
+	assert.Equal(t, nostr.Tag{"imeta", "url https://cdn.podcast.example/1.mp3", "m audio/mpeg", "size 24986239"}, evt.Tags[0])
+}
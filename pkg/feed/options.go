@@ -0,0 +1,94 @@
+package feed
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ArticleMode tells whether the items of a feed are published as NIP-23
+// long-form articles with their full content, besides or instead of notes.
+type ArticleMode string
+
+const (
+	ArticlesDisabled   ArticleMode = "disabled"
+	ArticlesAdditional ArticleMode = "additional"
+	ArticlesInstead    ArticleMode = "instead"
+)
+
+// ParseArticleMode validates an article mode, accepting empty ones.
+func ParseArticleMode(mode string) (ArticleMode, error) {
+	switch ArticleMode(mode) {
+	case "", ArticlesDisabled, ArticlesAdditional, ArticlesInstead:
+		return ArticleMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown article mode %q", mode)
+	}
+}
+
+// Options are the settings of a single feed. Empty values fall back to the
+// ones of the instance.
+type Options struct {
+	Articles      ArticleMode
+	MaxNoteLength int
+	MaxHashtags   *int
+	Edits         EditPolicy
+	TTL           time.Duration
+	// DeleteMissingItems publishes deletions for the items removed from the
+	// feed. It is opt-in, as many feeds just rotate their old items off.
+	DeleteMissingItems bool
+}
+
+// Settings configure how the items of a feed are converted into events, from
+// the options of the feed and the defaults of the instance.
+type Settings struct {
+	// MaxNoteLength is the maximum number of characters of notes before the
+	// link to the item.
+	MaxNoteLength int
+	// MaxHashtags is the maximum number of "t" tags taken from the categories
+	// of each item.
+	MaxHashtags int
+	// HashtagBlocklist are categories that are never turned into hashtags.
+	HashtagBlocklist []string
+	// AppendHashtags adds the hashtags to the content of notes too.
+	AppendHashtags bool
+	// TTL is how long events stay relevant after the date of their item, for
+	// NIP-40 expiration tags. Zero means they never expire.
+	TTL time.Duration
+}
+
+// Settings returns the settings of the feed, taking the defaults for the
+// options it doesn't set.
+func (o Options) Settings(defaults Settings) Settings {
+	settings := defaults
+	if o.MaxNoteLength > 0 {
+		settings.MaxNoteLength = o.MaxNoteLength
+	}
+	if o.MaxHashtags != nil {
+		settings.MaxHashtags = *o.MaxHashtags
+	}
+	if o.TTL > 0 {
+		settings.TTL = o.TTL
+	}
+	return settings
+}
+
+// GetOptions returns the options stored for the feed with the given url.
+func GetOptions(url string, db *sql.DB) Options {
+	var options Options
+	var ttl int64
+	row := db.QueryRow(`SELECT articles, max_note_length, max_hashtags, edits, ttl, delete_missing_items FROM feeds WHERE url=?`, url)
+	if err := row.Scan(&options.Articles, &options.MaxNoteLength, &options.MaxHashtags, &options.Edits, &ttl, &options.DeleteMissingItems); err != nil && err != sql.ErrNoRows {
+		log.Printf("failure to retrieve feed options: " + err.Error())
+	}
+	options.TTL = time.Duration(ttl) * time.Second
+	return options
+}
+
+// SaveOptions stores the options of the feed with the given url.
+func SaveOptions(url string, options Options, db *sql.DB) {
+	if _, err := db.Exec(`UPDATE feeds SET articles=?, max_note_length=?, max_hashtags=?, edits=?, ttl=?, delete_missing_items=? WHERE url=?`, options.Articles, options.MaxNoteLength, options.MaxHashtags, options.Edits, int64(options.TTL/time.Second), options.DeleteMissingItems, url); err != nil {
+		log.Printf("failure to save feed options: " + err.Error())
+	}
+}
@@ -0,0 +1,65 @@
+package feed
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// Truncate shortens content to at most max characters (runes), ellipsis
+// included. It cuts at the last word boundary when there is one reasonably
+// close, never inside a URL or in the middle of a character sequence such as
+// an emoji with modifiers. Content starting with a URL longer than max keeps
+// the whole URL.
+func Truncate(content string, max int) string {
+	runes := []rune(content)
+	if max <= 0 || len(runes) <= max {
+		return content
+	}
+
+	cut := max - 1
+	for _, span := range urlPattern.FindAllStringIndex(content, -1) {
+		start := len([]rune(content[:span[0]]))
+		end := start + len([]rune(content[span[0]:span[1]]))
+		if start < cut && cut < end {
+			cut = start
+			if cut == 0 {
+				// Better a longer text than just a broken link
+				cut = end
+			}
+			break
+		}
+	}
+	if cut >= len(runes) {
+		return content
+	}
+
+	// Look back for a space, but texts without them (e.g. Chinese or Japanese)
+	// can be cut anywhere
+	if !unicode.IsSpace(runes[cut]) {
+		for i := cut; i > cut/2; i-- {
+			if unicode.IsSpace(runes[i-1]) {
+				cut = i
+				break
+			}
+		}
+	}
+
+	for cut > 0 && joinsPrevious(runes[cut], runes[cut-1]) {
+		cut--
+	}
+
+	return strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace) + "…"
+}
+
+// joinsPrevious reports whether two runes are part of the same character as
+// displayed, so they must not be separated.
+func joinsPrevious(r rune, previous rune) bool {
+	const zeroWidthJoiner = '\u200d'
+	return r == zeroWidthJoiner || previous == zeroWidthJoiner ||
+		unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) ||
+		unicode.Is(unicode.Variation_Selector, r) ||
+		r >= 0x1F3FB && r <= 0x1F3FF // skin tone modifiers
+}
@@ -0,0 +1,90 @@
+package feed
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		max      int
+		expected string
+	}{
+		{
+			name:     "short enough",
+			content:  "Hello world",
+			max:      20,
+			expected: "Hello world",
+		},
+		{
+			name:     "cuts at word boundary",
+			content:  "The quick brown fox jumps over the lazy dog",
+			max:      18,
+			expected: "The quick brown…",
+		},
+		{
+			name:     "never inside a url",
+			content:  "Read more at https://example.com/a/very/long/path and more",
+			max:      30,
+			expected: "Read more at…",
+		},
+		{
+			name:     "keeps a leading url whole",
+			content:  "https://example.com/a/very/long/path and more",
+			max:      20,
+			expected: "https://example.com/a/very/long/path…",
+		},
+		{
+			name:     "oversized leading url",
+			content:  "https://example.com/aaaaaaaaaaaaaaaaaaaa \n",
+			max:      10,
+			expected: "https://example.com/aaaaaaaaaaaaaaaaaaaa…",
+		},
+		{
+			name:     "only a url",
+			content:  "https://example.com/aaaaaaaaaaaaaaaaaaaa",
+			max:      10,
+			expected: "https://example.com/aaaaaaaaaaaaaaaaaaaa",
+		},
+		{
+			name:     "cjk without spaces",
+			content:  "日本語のテキストはスペースなしで書かれています",
+			max:      10,
+			expected: "日本語のテキストは…",
+		},
+		{
+			name:     "emoji with skin tone",
+			content:  "👍🏽👍🏽👍🏽👍🏽",
+			max:      4,
+			expected: "👍🏽…",
+		},
+		{
+			name:     "emoji with zero width joiners",
+			content:  "👩‍👩‍👧👩‍👩‍👧",
+			max:      7,
+			expected: "👩‍👩‍👧…",
+		},
+		{
+			name:     "rtl text",
+			content:  "مرحبا بالعالم هذا نص طويل",
+			max:      16,
+			expected: "مرحبا بالعالم…",
+		},
+		{
+			name:     "no limit",
+			content:  "Anything goes",
+			max:      0,
+			expected: "Anything goes",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := Truncate(tc.content, tc.max)
+			assert.Equal(t, tc.expected, actual)
+			assert.True(t, utf8.ValidString(actual))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip42"
+	"github.com/piraces/rsslay/pkg/signer"
 	"log"
 	"sort"
 	"sync"
@@ -17,12 +18,9 @@ type ReplayParameters struct {
 	Queue                    *int
 	WaitTime                 int64
 	WaitTimeForRelayResponse int64
-	Events                   []EventWithPrivateKey
-}
-
-type EventWithPrivateKey struct {
-	Event      nostr.Event
-	PrivateKey string
+	Events                   []nostr.Event
+	// Signer signs the authentication events of the authors of Events.
+	Signer signer.Signer
 }
 
 func ReplayEventsToRelays(parameters *ReplayParameters) {
@@ -33,7 +31,7 @@ func ReplayEventsToRelays(parameters *ReplayParameters) {
 
 	if eventCount > parameters.MaxEventsToReplay {
 		sort.Slice(parameters.Events, func(i, j int) bool {
-			return parameters.Events[i].Event.CreatedAt.After(parameters.Events[j].Event.CreatedAt)
+			return parameters.Events[i].CreatedAt.After(parameters.Events[j].CreatedAt)
 		})
 		parameters.Events = parameters.Events[:parameters.MaxEventsToReplay]
 	}
@@ -52,10 +50,10 @@ func ReplayEventsToRelays(parameters *ReplayParameters) {
 
 			statusSummary := 0
 			for _, ev := range parameters.Events {
-				if shouldPerformAuthRequest && !tryAuth(relay, *challenge, url, parameters.WaitTimeForRelayResponse, &ev) {
+				if shouldPerformAuthRequest && !tryAuth(relay, *challenge, url, parameters.WaitTimeForRelayResponse, parameters.Signer, ev.PubKey) {
 					continue
 				}
-				publishStatus := relay.Publish(context.Background(), ev.Event)
+				publishStatus := relay.Publish(context.Background(), ev)
 				statusSummary = statusSummary | int(publishStatus)
 			}
 			log.Printf("Replayed %d events to %s with status summary %d\n", len(parameters.Events), url, statusSummary)
@@ -81,11 +79,11 @@ func needsAuth(relay *nostr.Relay, waitTime int64) (*string, bool) {
 	}
 }
 
-func tryAuth(relay *nostr.Relay, challenge string, url string, waitTime int64, ev *EventWithPrivateKey) bool {
-	event := nip42.CreateUnsignedAuthEvent(challenge, ev.Event.PubKey, url)
-	err := event.Sign(ev.PrivateKey)
+func tryAuth(relay *nostr.Relay, challenge string, url string, waitTime int64, s signer.Signer, pubkey string) bool {
+	event := nip42.CreateUnsignedAuthEvent(challenge, pubkey, url)
+	err := s.Sign(context.Background(), &event)
 	if err != nil {
-		log.Printf("Failed to sign event while trying to authenticate. PubKey: %s\n", ev.Event.PubKey)
+		log.Printf("Failed to sign event while trying to authenticate. PubKey: %s: %v\n", pubkey, err)
 		return false
 	}
 
@@ -97,7 +95,7 @@ func tryAuth(relay *nostr.Relay, challenge string, url string, waitTime int64, e
 	// Returned status is either success, fail, or sent (if no reply given in the 3-second timeout).
 	authStatus := relay.Auth(ctx, event)
 
-	log.Printf("authenticated as %s: %s\n", ev.Event.PubKey, authStatus)
+	log.Printf("authenticated as %s: %s\n", pubkey, authStatus)
 	if authStatus == nostr.PublishStatusSucceeded || authStatus == nostr.PublishStatusSent {
 		return true
 	}
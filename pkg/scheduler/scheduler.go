@@ -0,0 +1,262 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/piraces/rsslay/pkg/feed"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// PollFunc fetches a single feed and processes its new items, returning the
+// parsed feed or nil if it has not changed since the last poll.
+type PollFunc func(entity feed.Entity) (*gofeed.Feed, error)
+
+// Scheduler polls every registered feed on its own schedule, independently of
+// the subscriptions currently open, using a bounded pool of workers.
+// The interval of each feed is learned from its items and publisher hints, and
+// it is stored along with the next run time so both survive restarts.
+type Scheduler struct {
+	DB *sql.DB
+	// Poll is called for each feed when it is due.
+	Poll PollFunc
+	// Interval is the time between two polls of a feed when nothing can be
+	// learned from it.
+	Interval time.Duration
+	// MinInterval and MaxInterval bound the intervals learned from feeds.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Jitter is the maximum random time added to each interval, so feeds
+	// created at the same time spread out instead of being polled in bursts.
+	Jitter time.Duration
+	// Workers is the maximum number of feeds polled concurrently.
+	Workers int
+	// TickInterval is how often the database is checked for due feeds.
+	TickInterval time.Duration
+	// Health configures when failing feeds are degraded, suspended and dead.
+	// Failing feeds are backed off, and suspended or dead ones are only polled
+	// every MaxInterval to notice when they recover.
+	Health feed.HealthThresholds
+	// DeleteDeadFeeds removes feeds once they are dead instead of polling them.
+	DeleteDeadFeeds bool
+	// OnDelete, if set, is called with the public key of each deleted feed, to
+	// clean up what is kept outside the database (e.g. WebSub subscriptions).
+	OnDelete func(pubkey string)
+	// ShouldRun, if set, is checked on each tick and by PollNow, and polling is
+	// skipped when it returns false (e.g. when this node is a read-only replica).
+	ShouldRun func() bool
+
+	jobs     chan job
+	inFlight sync.Map
+	wg       sync.WaitGroup
+}
+
+type job struct {
+	entity     feed.Entity
+	interval   time.Duration
+	nextPollAt int64
+}
+
+// Start launches the workers and the scheduling loop until the context is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	s.jobs = make(chan job, workers)
+
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for j := range s.jobs {
+				s.pollAndReschedule(j)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.TickInterval)
+		defer ticker.Stop()
+		defer close(s.jobs)
+		for {
+			if s.ShouldRun == nil || s.ShouldRun() {
+				if _, err := s.dispatchDue(ctx, workers*4); err != nil {
+					log.Printf("scheduler: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Wait blocks until all workers have finished after the context passed to
+// Start is done.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// PollNow polls a feed synchronously and updates its schedule, unless polling
+// should not run on this node.
+func (s *Scheduler) PollNow(entity feed.Entity) error {
+	if s.ShouldRun != nil && !s.ShouldRun() {
+		return nil
+	}
+	if _, loaded := s.inFlight.LoadOrStore(entity.PublicKey, true); loaded {
+		return nil
+	}
+	defer s.inFlight.Delete(entity.PublicKey)
+
+	var interval int64
+	_ = s.DB.QueryRow(`SELECT poll_interval FROM feeds WHERE publickey=?`, entity.PublicKey).Scan(&interval)
+
+	return s.poll(job{entity: entity, interval: time.Duration(interval) * time.Second})
+}
+
+// NeverPolled reports whether the feed with the given public key has not been
+// polled yet.
+func (s *Scheduler) NeverPolled(pubkey string) bool {
+	var lastPolledAt int64
+	err := s.DB.QueryRow(`SELECT last_polled_at FROM feeds WHERE publickey=?`, pubkey).Scan(&lastPolledAt)
+	return err == nil && lastPolledAt == 0
+}
+
+// dispatchDue hands every due feed to the workers, reading them in batches of
+// the given size. Handing them over blocks while the workers are busy, so a
+// tick lasts until the whole backlog is dispatched.
+func (s *Scheduler) dispatchDue(ctx context.Context, batch int) (int, error) {
+	now := time.Now().Unix()
+	dispatched := 0
+	// Feeds are read in (next_poll_at, publickey) order, after the last one read
+	var afterPollAt int64 = -1
+	afterPubKey := ""
+	for {
+		due, err := s.dueFeeds(now, afterPollAt, afterPubKey, batch)
+		if err != nil {
+			return dispatched, err
+		}
+
+		for _, j := range due {
+			afterPollAt, afterPubKey = j.nextPollAt, j.entity.PublicKey
+			if _, loaded := s.inFlight.LoadOrStore(j.entity.PublicKey, true); loaded {
+				continue
+			}
+			select {
+			case s.jobs <- j:
+				dispatched++
+			case <-ctx.Done():
+				s.inFlight.Delete(j.entity.PublicKey)
+				return dispatched, nil
+			}
+		}
+
+		if len(due) < batch {
+			return dispatched, nil
+		}
+	}
+}
+
+// dueFeeds returns up to limit feeds due at now, following the given position.
+func (s *Scheduler) dueFeeds(now int64, afterPollAt int64, afterPubKey string, limit int) ([]job, error) {
+	rows, err := s.DB.Query(`SELECT publickey, privatekey, url, poll_interval, next_poll_at FROM feeds WHERE next_poll_at <= ? AND (next_poll_at > ? OR (next_poll_at = ? AND publickey > ?)) ORDER BY next_poll_at, publickey LIMIT ?`,
+		now, afterPollAt, afterPollAt, afterPubKey, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve due feeds: %w", err)
+	}
+	defer rows.Close()
+
+	var due []job
+	for rows.Next() {
+		var j job
+		var interval int64
+		if err := rows.Scan(&j.entity.PublicKey, &j.entity.PrivateKey, &j.entity.URL, &interval, &j.nextPollAt); err != nil {
+			return nil, fmt.Errorf("failed to scan due feed: %w", err)
+		}
+		j.interval = time.Duration(interval) * time.Second
+		due = append(due, j)
+	}
+	return due, rows.Err()
+}
+
+func (s *Scheduler) pollAndReschedule(j job) {
+	defer s.inFlight.Delete(j.entity.PublicKey)
+	if err := s.poll(j); err != nil {
+		log.Printf("scheduler: failed to poll feed at url %q: %v", j.entity.URL, err)
+	}
+}
+
+func (s *Scheduler) poll(j job) error {
+	parsedFeed, err := s.Poll(j.entity)
+
+	// Unchanged feeds keep the interval learned on the last successful poll
+	now := time.Now()
+	learned := j.interval
+	if parsedFeed != nil {
+		learned = feed.PollInterval(parsedFeed, now, s.MinInterval, s.MaxInterval)
+	}
+	interval := learned
+	if interval <= 0 {
+		interval = s.Interval
+	}
+
+	if errors.Is(err, feed.ErrNotProcessed) {
+		// The feed is fine, its events are retried on the next poll
+		interval = s.Interval
+	} else if err != nil {
+		health, healthErr := feed.RecordFetchFailure(j.entity.URL, err, s.Health, s.DB)
+		if healthErr != nil {
+			log.Printf("scheduler: %v", healthErr)
+		}
+		switch health.State {
+		case feed.HealthDead:
+			if s.DeleteDeadFeeds {
+				feed.DeleteInvalidFeed(j.entity.URL, s.DB)
+				if s.OnDelete != nil {
+					s.OnDelete(j.entity.PublicKey)
+				}
+				return err
+			}
+			interval = s.MaxInterval
+		case feed.HealthSuspended:
+			interval = s.MaxInterval
+		default:
+			interval = s.backoff(interval, health.ConsecutiveFailures)
+		}
+	} else {
+		feed.RecordFetchSuccess(j.entity.URL, s.DB)
+	}
+
+	next := feed.NextPollAt(parsedFeed, now, interval+s.jitter())
+	if _, dbErr := s.DB.Exec(`UPDATE feeds SET next_poll_at=?, last_polled_at=?, poll_interval=? WHERE publickey=?`, next.Unix(), now.Unix(), int64(learned/time.Second), j.entity.PublicKey); dbErr != nil {
+		log.Printf("scheduler: failed to reschedule feed at url %q: %v", j.entity.URL, dbErr)
+	}
+
+	return err
+}
+
+// backoff doubles the interval for each consecutive failure, up to MaxInterval.
+func (s *Scheduler) backoff(interval time.Duration, failures int) time.Duration {
+	for i := 0; i < failures && interval < s.MaxInterval; i++ {
+		interval *= 2
+	}
+	if interval > s.MaxInterval {
+		interval = s.MaxInterval
+	}
+	return interval
+}
+
+func (s *Scheduler) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.Jitter)))
+}
@@ -0,0 +1,290 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/piraces/rsslay/pkg/feed"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+var sampleThresholds = feed.HealthThresholds{
+	DegradedAfter:  2,
+	SuspendedAfter: 3,
+	DeadAfter:      time.Hour,
+}
+
+func insertFeed(t *testing.T, db *sql.DB, pubkey string, nextPollAt int64) {
+	if _, err := db.Exec(`INSERT INTO feeds (publickey, privatekey, url, next_poll_at) VALUES (?, ?, ?, ?)`, pubkey, "sk", "https://"+pubkey+".example/rss", nextPollAt); err != nil {
+		t.Fatalf("an error '%s' was not expected when inserting a feed", err)
+	}
+}
+
+func nextPollAt(t *testing.T, db *sql.DB, pubkey string) int64 {
+	var next int64
+	if err := db.QueryRow(`SELECT next_poll_at FROM feeds WHERE publickey=?`, pubkey).Scan(&next); err != nil {
+		t.Fatalf("an error '%s' was not expected when reading a feed", err)
+	}
+	return next
+}
+
+func TestSchedulerPollsOnlyDueFeedsAndReschedulesThem(t *testing.T) {
+	db := testdb.Open(t)
+	future := time.Now().Add(time.Hour).Unix()
+	insertFeed(t, db, "due", 0)
+	insertFeed(t, db, "failing", 0)
+	insertFeed(t, db, "later", future)
+
+	var mutex sync.Mutex
+	var polled []string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	s := &Scheduler{
+		DB: db,
+		Poll: func(entity feed.Entity) (*gofeed.Feed, error) {
+			defer wg.Done()
+			mutex.Lock()
+			defer mutex.Unlock()
+			polled = append(polled, entity.PublicKey)
+			if entity.PublicKey == "failing" {
+				return nil, errors.New("unreachable")
+			}
+			return nil, nil
+		},
+		Interval:     time.Minute,
+		MaxInterval:  time.Hour,
+		Workers:      2,
+		TickInterval: time.Hour,
+		Health:       sampleThresholds,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	wg.Wait()
+	cancel()
+	s.Wait()
+
+	assert.ElementsMatch(t, []string{"due", "failing"}, polled)
+	assert.GreaterOrEqual(t, nextPollAt(t, db, "due"), time.Now().Add(59*time.Second).Unix())
+	assert.GreaterOrEqual(t, nextPollAt(t, db, "failing"), time.Now().Add(119*time.Second).Unix())
+	assert.Equal(t, future, nextPollAt(t, db, "later"))
+	assert.False(t, s.NeverPolled("due"))
+	assert.True(t, s.NeverPolled("later"))
+}
+
+func TestSchedulerSkipsTicksWhenItShouldNotRun(t *testing.T) {
+	db := testdb.Open(t)
+	insertFeed(t, db, "due", 0)
+
+	s := &Scheduler{
+		DB: db,
+		Poll: func(entity feed.Entity) (*gofeed.Feed, error) {
+			t.Errorf("feed %s should not be polled", entity.PublicKey)
+			return nil, nil
+		},
+		Interval:     time.Minute,
+		Workers:      1,
+		TickInterval: time.Hour,
+		ShouldRun:    func() bool { return false },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	s.Wait()
+
+	assert.Equal(t, int64(0), nextPollAt(t, db, "due"))
+}
+
+func TestPollNowUpdatesSchedule(t *testing.T) {
+	db := testdb.Open(t)
+	insertFeed(t, db, "new", 0)
+
+	s := &Scheduler{
+		DB:       db,
+		Poll:     func(entity feed.Entity) (*gofeed.Feed, error) { return nil, nil },
+		Interval: time.Minute,
+		Jitter:   time.Second,
+	}
+	assert.True(t, s.NeverPolled("new"))
+	assert.NoError(t, s.PollNow(feed.Entity{PublicKey: "new"}))
+	assert.False(t, s.NeverPolled("new"))
+}
+
+func TestPollNowSkipsFeedsWhenItShouldNotRun(t *testing.T) {
+	db := testdb.Open(t)
+	insertFeed(t, db, "new", 0)
+
+	s := &Scheduler{
+		DB: db,
+		Poll: func(entity feed.Entity) (*gofeed.Feed, error) {
+			t.Errorf("feed %s should not be polled", entity.PublicKey)
+			return nil, nil
+		},
+		Interval:  time.Minute,
+		ShouldRun: func() bool { return false },
+	}
+	assert.NoError(t, s.PollNow(feed.Entity{PublicKey: "new"}))
+	assert.True(t, s.NeverPolled("new"))
+}
+
+func TestPollStoresLearnedIntervalAndKeepsItWhenUnchanged(t *testing.T) {
+	db := testdb.Open(t)
+	insertFeed(t, db, "hourly", 0)
+
+	now := time.Now()
+	first := now.Add(-2 * time.Hour)
+	second := now.Add(-4 * time.Hour)
+	parsedFeed := &gofeed.Feed{Items: []*gofeed.Item{{PublishedParsed: &first}, {PublishedParsed: &second}}}
+	s := &Scheduler{
+		DB:          db,
+		Poll:        func(entity feed.Entity) (*gofeed.Feed, error) { return parsedFeed, nil },
+		Interval:    time.Minute,
+		MinInterval: time.Minute,
+		MaxInterval: 24 * time.Hour,
+	}
+	assert.NoError(t, s.PollNow(feed.Entity{PublicKey: "hourly"}))
+	assert.Equal(t, int64(3600), pollInterval(t, db, "hourly"))
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), nextPollAt(t, db, "hourly"), 5)
+
+	parsedFeed = nil
+	assert.NoError(t, s.PollNow(feed.Entity{PublicKey: "hourly"}))
+	assert.Equal(t, int64(3600), pollInterval(t, db, "hourly"))
+}
+
+func pollInterval(t *testing.T, db *sql.DB, pubkey string) int64 {
+	var interval int64
+	if err := db.QueryRow(`SELECT poll_interval FROM feeds WHERE publickey=?`, pubkey).Scan(&interval); err != nil {
+		t.Fatalf("an error '%s' was not expected when reading a feed", err)
+	}
+	return interval
+}
+
+func TestFailingFeedsChangeHealthAndRevive(t *testing.T) {
+	db := testdb.Open(t)
+	insertFeed(t, db, "flaky", 0)
+	url := "https://flaky.example/rss"
+
+	var pollErr error
+	s := &Scheduler{
+		DB:          db,
+		Poll:        func(entity feed.Entity) (*gofeed.Feed, error) { return nil, pollErr },
+		Interval:    time.Minute,
+		MaxInterval: time.Hour,
+		Health:      sampleThresholds,
+	}
+
+	pollErr = errors.New("timeout")
+	expectedStates := []feed.HealthState{feed.HealthHealthy, feed.HealthDegraded, feed.HealthSuspended}
+	for _, expected := range expectedStates {
+		assert.Error(t, s.PollNow(feed.Entity{PublicKey: "flaky", URL: url}))
+		health, err := feed.GetHealth(url, db)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, health.State)
+		assert.Equal(t, "timeout", health.LastError)
+	}
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), nextPollAt(t, db, "flaky"), 5)
+
+	pollErr = nil
+	assert.NoError(t, s.PollNow(feed.Entity{PublicKey: "flaky", URL: url}))
+	health, err := feed.GetHealth(url, db)
+	assert.NoError(t, err)
+	assert.Equal(t, feed.HealthHealthy, health.State)
+	assert.Equal(t, 0, health.ConsecutiveFailures)
+	assert.False(t, health.LastSuccessAt.IsZero())
+	assert.True(t, health.FailingSince.IsZero())
+}
+
+func TestFeedsNotFullyProcessedAreNotFailing(t *testing.T) {
+	db := testdb.Open(t)
+	insertFeed(t, db, "unsigned", 0)
+	url := "https://unsigned.example/rss"
+
+	s := &Scheduler{
+		DB: db,
+		Poll: func(entity feed.Entity) (*gofeed.Feed, error) {
+			return nil, fmt.Errorf("%w: bunker unreachable", feed.ErrNotProcessed)
+		},
+		Interval:    time.Minute,
+		MaxInterval: time.Hour,
+		Health:      sampleThresholds,
+	}
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, s.PollNow(feed.Entity{PublicKey: "unsigned", URL: url}), feed.ErrNotProcessed)
+	}
+	health, err := feed.GetHealth(url, db)
+	assert.NoError(t, err)
+	assert.Equal(t, feed.HealthHealthy, health.State)
+	assert.Equal(t, 0, health.ConsecutiveFailures)
+	assert.True(t, health.LastSuccessAt.IsZero())
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), nextPollAt(t, db, "unsigned"), 5)
+}
+
+func TestDeadFeedsAreDeletedOnlyWhenConfigured(t *testing.T) {
+	db := testdb.Open(t)
+	insertFeed(t, db, "dead", 0)
+	url := "https://dead.example/rss"
+	longAgo := time.Now().Add(-2 * time.Hour).Unix()
+	if _, err := db.Exec(`UPDATE feeds SET consecutive_failures=5, failing_since=? WHERE url=?`, longAgo, url); err != nil {
+		t.Fatalf("an error '%s' was not expected when updating a feed", err)
+	}
+
+	s := &Scheduler{
+		DB:          db,
+		Poll:        func(entity feed.Entity) (*gofeed.Feed, error) { return nil, errors.New("gone") },
+		Interval:    time.Minute,
+		MaxInterval: time.Hour,
+		Health:      sampleThresholds,
+	}
+	assert.Error(t, s.PollNow(feed.Entity{PublicKey: "dead", URL: url}))
+	health, err := feed.GetHealth(url, db)
+	assert.NoError(t, err)
+	assert.Equal(t, feed.HealthDead, health.State)
+
+	var deleted []string
+	s.DeleteDeadFeeds = true
+	s.OnDelete = func(pubkey string) { deleted = append(deleted, pubkey) }
+	assert.Error(t, s.PollNow(feed.Entity{PublicKey: "dead", URL: url}))
+	_, err = feed.GetHealth(url, db)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Equal(t, []string{"dead"}, deleted)
+}
+
+func TestSchedulerDispatchesMoreDueFeedsThanOneBatch(t *testing.T) {
+	db := testdb.Open(t)
+	// One worker reads batches of 4 feeds
+	pubkeys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	for i, pubkey := range pubkeys {
+		insertFeed(t, db, pubkey, int64(i%3))
+	}
+
+	var mutex sync.Mutex
+	var polled []string
+	var wg sync.WaitGroup
+	wg.Add(len(pubkeys))
+	s := &Scheduler{
+		DB: db,
+		Poll: func(entity feed.Entity) (*gofeed.Feed, error) {
+			defer wg.Done()
+			mutex.Lock()
+			defer mutex.Unlock()
+			polled = append(polled, entity.PublicKey)
+			return nil, nil
+		},
+		Interval:     time.Minute,
+		Workers:      1,
+		TickInterval: time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	wg.Wait()
+	cancel()
+	s.Wait()
+
+	assert.ElementsMatch(t, pubkeys, polled)
+}
@@ -0,0 +1,430 @@
+package signer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// KindNostrConnect is the kind of the NIP-46 requests and responses exchanged
+// between clients and bunkers.
+const KindNostrConnect = 24133
+
+// ErrUnauthorized is returned by bunkers to clients not allowed to use them.
+var ErrUnauthorized = errors.New("unauthorized client")
+
+// Transport carries NIP-46 messages between clients and bunkers, usually
+// through a relay. Subscriptions end, closing their channel, when the context
+// is done or the transport is disconnected.
+type Transport interface {
+	Publish(ctx context.Context, evt nostr.Event) error
+	Subscribe(ctx context.Context, filter nostr.Filter) (<-chan *nostr.Event, error)
+}
+
+type request struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type response struct {
+	ID     string `json:"id"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ParseBunkerURL returns the public key and relay of a bunker from its
+// "bunker://<pubkey>?relay=<url>" connection URL.
+func ParseBunkerURL(bunkerUrl string) (string, string, error) {
+	u, err := url.Parse(bunkerUrl)
+	if err != nil || u.Scheme != "bunker" {
+		return "", "", errors.New("expected bunker://<pubkey>?relay=<url>")
+	}
+	pubkey := u.Host
+	if key, err := hex.DecodeString(pubkey); err != nil || len(key) != 32 {
+		return "", "", fmt.Errorf("invalid bunker public key %q", pubkey)
+	}
+	relay := u.Query().Get("relay")
+	if relay == "" {
+		return "", "", errors.New("the bunker URL has no relay")
+	}
+	return pubkey, relay, nil
+}
+
+// Remotes keeps a Remote for each bunker URL, all of them connecting with the
+// same client key, so the bunkers of many owners can be used at once.
+type Remotes struct {
+	ClientKey string
+	Timeout   time.Duration
+
+	mutex   sync.Mutex
+	remotes map[string]*Remote
+}
+
+// Get returns the Remote of a bunker URL, creating it on first use.
+func (r *Remotes) Get(bunkerUrl string) (*Remote, error) {
+	if r.ClientKey == "" {
+		return nil, errors.New("no client key to connect to bunkers")
+	}
+	pubkey, relay, err := ParseBunkerURL(bunkerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if remote, ok := r.remotes[bunkerUrl]; ok {
+		return remote, nil
+	}
+	if r.remotes == nil {
+		r.remotes = map[string]*Remote{}
+	}
+	u, _ := url.Parse(bunkerUrl)
+	remote := &Remote{
+		BunkerPublicKey: pubkey,
+		ClientKey:       r.ClientKey,
+		Secret:          u.Query().Get("secret"),
+		Transport:       &RelayTransport{URL: relay},
+		Timeout:         r.Timeout,
+	}
+	r.remotes[bunkerUrl] = remote
+	return remote, nil
+}
+
+// Forget drops the Remote of a bunker URL, disconnecting from its relay, as when
+// the bunker turns out not to be usable.
+func (r *Remotes) Forget(bunkerUrl string) {
+	r.mutex.Lock()
+	remote, ok := r.remotes[bunkerUrl]
+	delete(r.remotes, bunkerUrl)
+	r.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if transport, isRelay := remote.Transport.(*RelayTransport); isRelay {
+		transport.Close()
+	}
+}
+
+// BunkerURL returns the connection URL of a bunker.
+func BunkerURL(pubkey string, relay string) string {
+	return "bunker://" + pubkey + "?" + url.Values{"relay": {relay}}.Encode()
+}
+
+// Remote signs events with a NIP-46 bunker, so private keys can be kept in
+// another process. Requests are signed and encrypted with the client key, which
+// the bunker must allow.
+type Remote struct {
+	BunkerPublicKey string
+	ClientKey       string
+	// Secret is the optional secret of the bunker URL, sent when connecting.
+	Secret    string
+	Transport Transport
+	// Timeout is how long to wait for the bunker to answer each request.
+	Timeout time.Duration
+
+	mutex     sync.Mutex
+	pending   map[string]chan response
+	listening bool
+}
+
+func (s *Remote) Sign(ctx context.Context, evt *nostr.Event) error {
+	// The id and signature are set by the bunker
+	unsignedEvt := *evt
+	unsignedEvt.ID, unsignedEvt.Sig = "", ""
+	unsigned, err := json.Marshal(unsignedEvt)
+	if err != nil {
+		return err
+	}
+	result, err := s.Call(ctx, "sign_event", string(unsigned))
+	if err != nil {
+		return err
+	}
+
+	var signed nostr.Event
+	if err := json.Unmarshal([]byte(result), &signed); err != nil {
+		return fmt.Errorf("invalid event signed by the bunker: %w", err)
+	}
+	if signed.PubKey != evt.PubKey || signed.GetID() != evt.GetID() {
+		return errors.New("the bunker signed a different event")
+	}
+	if ok, _ := signed.CheckSignature(); !ok {
+		return errors.New("the bunker returned an invalid signature")
+	}
+	evt.ID = signed.ID
+	evt.Sig = signed.Sig
+	return nil
+}
+
+// Connect asks the bunker to accept this client, with the secret of the bunker
+// URL if any.
+func (s *Remote) Connect(ctx context.Context) error {
+	params := []string{s.BunkerPublicKey}
+	if s.Secret != "" {
+		params = append(params, s.Secret)
+	}
+	_, err := s.Call(ctx, "connect", params...)
+	return err
+}
+
+// Ping checks that the bunker answers the requests of this client.
+func (s *Remote) Ping(ctx context.Context) error {
+	_, err := s.Call(ctx, "ping")
+	return err
+}
+
+// Call sends a request to the bunker and waits for its result, so methods
+// other than the NIP-46 ones can be used with bunkers serving them.
+func (s *Remote) Call(ctx context.Context, method string, params ...string) (string, error) {
+	clientPubKey, err := nostr.GetPublicKey(s.ClientKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid client key: %w", err)
+	}
+	if err := s.listen(clientPubKey); err != nil {
+		return "", err
+	}
+
+	id := randomID()
+	responses := make(chan response, 1)
+	s.mutex.Lock()
+	s.pending[id] = responses
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, id)
+		s.mutex.Unlock()
+	}()
+
+	content, err := json.Marshal(request{ID: id, Method: method, Params: params})
+	if err != nil {
+		return "", err
+	}
+	requestEvent, err := message(s.ClientKey, clientPubKey, s.BunkerPublicKey, content)
+	if err != nil {
+		return "", err
+	}
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	if err := s.Transport.Publish(ctx, requestEvent); err != nil {
+		return "", fmt.Errorf("failed to send %s request to the bunker: %w", method, err)
+	}
+
+	select {
+	case resp := <-responses:
+		if resp.Error != "" {
+			return "", fmt.Errorf("the bunker refused to %s: %s", method, resp.Error)
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("no answer from the bunker to %s: %w", method, ctx.Err())
+	}
+}
+
+// listen subscribes to the responses of the bunker, unless already subscribed,
+// and dispatches them to the pending requests.
+func (s *Remote) listen(clientPubKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listening {
+		return nil
+	}
+	if s.pending == nil {
+		s.pending = map[string]chan response{}
+	}
+
+	events, err := s.Transport.Subscribe(context.Background(), nostr.Filter{
+		Kinds:   []int{KindNostrConnect},
+		Authors: []string{s.BunkerPublicKey},
+		Tags:    nostr.TagMap{"p": {clientPubKey}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to the bunker: %w", err)
+	}
+	s.listening = true
+
+	go func() {
+		for evt := range events {
+			var resp response
+			if err := open(s.ClientKey, evt, &resp); err != nil {
+				continue
+			}
+			s.mutex.Lock()
+			if responses, ok := s.pending[resp.ID]; ok {
+				responses <- resp
+				delete(s.pending, resp.ID)
+			}
+			s.mutex.Unlock()
+		}
+
+		// Subscribe again on the next request
+		s.mutex.Lock()
+		s.listening = false
+		s.mutex.Unlock()
+	}()
+
+	return nil
+}
+
+// Bunker answers the NIP-46 requests of the allowed clients, signing events
+// with Signer, usually a Local one holding the private keys of the feeds.
+type Bunker struct {
+	PrivateKey string
+	// Clients are the public keys of the clients allowed to use the bunker.
+	Clients   []string
+	Signer    Signer
+	Transport Transport
+	// Methods answers requests for methods other than the NIP-46 ones, if any.
+	Methods map[string]func(ctx context.Context, params []string) (string, error)
+}
+
+// Serve answers requests until the context is done or the transport is
+// disconnected.
+func (b *Bunker) Serve(ctx context.Context) error {
+	pubkey, err := nostr.GetPublicKey(b.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid bunker key: %w", err)
+	}
+
+	// created_at has a precision of seconds
+	now := time.Now().Truncate(time.Second)
+	requests, err := b.Transport.Subscribe(ctx, nostr.Filter{
+		Kinds: []int{KindNostrConnect},
+		Tags:  nostr.TagMap{"p": {pubkey}},
+		Since: &now,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to requests: %w", err)
+	}
+
+	for evt := range requests {
+		if ok, _ := evt.CheckSignature(); !ok {
+			continue
+		}
+		var req request
+		if err := open(b.PrivateKey, evt, &req); err != nil {
+			continue
+		}
+
+		resp := b.handle(ctx, evt.PubKey, req)
+		content, err := json.Marshal(resp)
+		if err != nil {
+			continue
+		}
+		responseEvent, err := message(b.PrivateKey, pubkey, evt.PubKey, content)
+		if err != nil {
+			log.Printf("bunker: failed to answer %s request: %v", req.Method, err)
+			continue
+		}
+		if err := b.Transport.Publish(ctx, responseEvent); err != nil {
+			log.Printf("bunker: failed to answer %s request: %v", req.Method, err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("disconnected from the transport")
+}
+
+func (b *Bunker) handle(ctx context.Context, client string, req request) response {
+	resp := response{ID: req.ID}
+	if !b.allowed(client) {
+		resp.Error = ErrUnauthorized.Error()
+		return resp
+	}
+
+	switch req.Method {
+	case "connect":
+		resp.Result = "ack"
+	case "ping":
+		resp.Result = "pong"
+	case "sign_event":
+		var evt nostr.Event
+		if len(req.Params) != 1 || json.Unmarshal([]byte(req.Params[0]), &evt) != nil {
+			resp.Error = "invalid event"
+			break
+		}
+		if err := b.Signer.Sign(ctx, &evt); err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		signed, _ := json.Marshal(evt)
+		resp.Result = string(signed)
+	default:
+		method, ok := b.Methods[req.Method]
+		if !ok {
+			resp.Error = "unsupported method " + req.Method
+			break
+		}
+		result, err := method(ctx, req.Params)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Result = result
+	}
+	return resp
+}
+
+func (b *Bunker) allowed(client string) bool {
+	for _, c := range b.Clients {
+		if c == client {
+			return true
+		}
+	}
+	return false
+}
+
+// message returns a NIP-46 message from the key pair of the sender, with its
+// content encrypted to the receiver.
+func message(sk string, pubkey string, receiver string, content []byte) (nostr.Event, error) {
+	secret, err := nip04.ComputeSharedSecret(receiver, sk)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	encrypted, err := nip04.Encrypt(string(content), secret)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: time.Now(),
+		Kind:      KindNostrConnect,
+		Tags:      nostr.Tags{{"p", receiver}},
+		Content:   encrypted,
+	}
+	return evt, evt.Sign(sk)
+}
+
+// open decrypts the content of a NIP-46 message received with the given key.
+func open(sk string, evt *nostr.Event, v any) error {
+	secret, err := nip04.ComputeSharedSecret(evt.PubKey, sk)
+	if err != nil {
+		return err
+	}
+	content, err := nip04.Decrypt(evt.Content, secret)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(content), v)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,213 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryTransport stands in for a relay, delivering the messages published to
+// the matching subscriptions of the same process.
+type memoryTransport struct {
+	mutex         sync.Mutex
+	subscriptions map[chan *nostr.Event]nostr.Filter
+}
+
+func (m *memoryTransport) Publish(_ context.Context, evt nostr.Event) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for events, filter := range m.subscriptions {
+		if filter.Matches(&evt) {
+			received := evt
+			go func(events chan *nostr.Event) { events <- &received }(events)
+		}
+	}
+	return nil
+}
+
+func (m *memoryTransport) Subscribe(ctx context.Context, filter nostr.Filter) (<-chan *nostr.Event, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.subscriptions == nil {
+		m.subscriptions = map[chan *nostr.Event]nostr.Filter{}
+	}
+	received := make(chan *nostr.Event)
+	m.subscriptions[received] = filter
+
+	events := make(chan *nostr.Event)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case evt := <-received:
+				events <- evt
+			case <-ctx.Done():
+				m.mutex.Lock()
+				delete(m.subscriptions, received)
+				m.mutex.Unlock()
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func startBunker(t *testing.T, clients ...string) (*memoryTransport, string) {
+	transport := &memoryTransport{}
+	bunkerKey := nostr.GeneratePrivateKey()
+	bunker := &Bunker{
+		PrivateKey: bunkerKey,
+		Clients:    clients,
+		Signer:     &Local{Key: sampleKeys},
+		Transport:  transport,
+		Methods: map[string]func(ctx context.Context, params []string) (string, error){
+			"echo": func(_ context.Context, params []string) (string, error) {
+				if len(params) == 0 {
+					return "", errors.New("nothing to echo")
+				}
+				return params[0], nil
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- bunker.Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+
+	// Wait for the bunker to subscribe
+	for {
+		transport.mutex.Lock()
+		subscribed := len(transport.subscriptions) > 0
+		transport.mutex.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	bunkerPubKey, _ := nostr.GetPublicKey(bunkerKey)
+	return transport, bunkerPubKey
+}
+
+func TestRemoteSignsWithTheBunker(t *testing.T) {
+	clientKey := nostr.GeneratePrivateKey()
+	clientPubKey, _ := nostr.GetPublicKey(clientKey)
+	transport, bunkerPubKey := startBunker(t, clientPubKey)
+
+	s := &Remote{BunkerPublicKey: bunkerPubKey, ClientKey: clientKey, Transport: transport, Timeout: 5 * time.Second}
+	assert.NoError(t, s.Connect(context.Background()))
+	assert.NoError(t, s.Ping(context.Background()))
+
+	// Events may come with a placeholder id, like the ones converted from feeds
+	evt := sampleEvent(samplePubKey)
+	evt.ID = string(evt.Serialize())
+	assert.NoError(t, s.Sign(context.Background(), &evt))
+	ok, err := evt.CheckSignature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, evt.GetID(), evt.ID)
+
+	// Keys the bunker doesn't hold can't be used
+	other := sampleEvent(clientPubKey)
+	assert.ErrorContains(t, s.Sign(context.Background(), &other), "the bunker refused to sign_event")
+	assert.Empty(t, other.Sig)
+}
+
+func TestRemoteCallsOtherMethodsOfTheBunker(t *testing.T) {
+	clientKey := nostr.GeneratePrivateKey()
+	clientPubKey, _ := nostr.GetPublicKey(clientKey)
+	transport, bunkerPubKey := startBunker(t, clientPubKey)
+	s := &Remote{BunkerPublicKey: bunkerPubKey, ClientKey: clientKey, Transport: transport, Timeout: 5 * time.Second}
+
+	result, err := s.Call(context.Background(), "echo", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", result)
+	_, err = s.Call(context.Background(), "echo")
+	assert.ErrorContains(t, err, "nothing to echo")
+	_, err = s.Call(context.Background(), "unknown")
+	assert.ErrorContains(t, err, "unsupported method unknown")
+}
+
+func TestRemoteSignsConcurrently(t *testing.T) {
+	clientKey := nostr.GeneratePrivateKey()
+	clientPubKey, _ := nostr.GetPublicKey(clientKey)
+	transport, bunkerPubKey := startBunker(t, clientPubKey)
+	s := &Remote{BunkerPublicKey: bunkerPubKey, ClientKey: clientKey, Transport: transport, Timeout: 5 * time.Second}
+
+	var wg sync.WaitGroup
+	signed := make([]nostr.Event, 5)
+	for i := range signed {
+		signed[i] = sampleEvent(samplePubKey)
+		signed[i].Content = string(rune('a' + i))
+		wg.Add(1)
+		go func(evt *nostr.Event) {
+			defer wg.Done()
+			assert.NoError(t, s.Sign(context.Background(), evt))
+		}(&signed[i])
+	}
+	wg.Wait()
+
+	for _, evt := range signed {
+		ok, _ := evt.CheckSignature()
+		assert.True(t, ok)
+	}
+}
+
+func TestBunkerRefusesUnknownClients(t *testing.T) {
+	transport, bunkerPubKey := startBunker(t, "someone else")
+
+	s := &Remote{BunkerPublicKey: bunkerPubKey, ClientKey: nostr.GeneratePrivateKey(), Transport: transport, Timeout: 5 * time.Second}
+	evt := sampleEvent(samplePubKey)
+	assert.ErrorContains(t, s.Sign(context.Background(), &evt), ErrUnauthorized.Error())
+	assert.Empty(t, evt.Sig)
+}
+
+func TestRemoteTimesOutWithoutBunker(t *testing.T) {
+	bunkerPubKey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	s := &Remote{BunkerPublicKey: bunkerPubKey, ClientKey: nostr.GeneratePrivateKey(), Transport: &memoryTransport{}, Timeout: 50 * time.Millisecond}
+
+	evt := sampleEvent(samplePubKey)
+	assert.ErrorIs(t, s.Sign(context.Background(), &evt), context.DeadlineExceeded)
+}
+
+func TestParseBunkerURL(t *testing.T) {
+	pubkey, relay, err := ParseBunkerURL(BunkerURL(samplePubKey, "wss://relay.example"))
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, pubkey)
+	assert.Equal(t, "wss://relay.example", relay)
+
+	for _, invalid := range []string{"", "https://relay.example", "bunker://abc?relay=wss://relay.example", "bunker://" + samplePubKey} {
+		_, _, err := ParseBunkerURL(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRemotesKeepARemotePerBunker(t *testing.T) {
+	bunkerUrl := BunkerURL(samplePubKey, "wss://relay.example") + "&secret=s3cret"
+	_, err := (&Remotes{}).Get(bunkerUrl)
+	assert.Error(t, err)
+
+	remotes := &Remotes{ClientKey: nostr.GeneratePrivateKey(), Timeout: time.Second}
+	remote, err := remotes.Get(bunkerUrl)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePubKey, remote.BunkerPublicKey)
+	assert.Equal(t, "s3cret", remote.Secret)
+	assert.Equal(t, "wss://relay.example", remote.Transport.(*RelayTransport).URL)
+	again, _ := remotes.Get(bunkerUrl)
+	assert.Same(t, remote, again)
+
+	remotes.Forget(bunkerUrl)
+	again, _ = remotes.Get(bunkerUrl)
+	assert.NotSame(t, remote, again)
+
+	_, err = remotes.Get("bunker://" + samplePubKey)
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"log"
+	"sync"
+)
+
+// RelayTransport carries NIP-46 messages through a relay, connecting again on
+// the next message when the connection is lost.
+type RelayTransport struct {
+	URL string
+
+	mutex sync.Mutex
+	relay *nostr.Relay
+	lost  chan struct{}
+}
+
+func (t *RelayTransport) Publish(ctx context.Context, evt nostr.Event) error {
+	relay, _, err := t.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if relay.Publish(ctx, evt) == nostr.PublishStatusFailed {
+		return errors.New("rejected by the relay")
+	}
+	return nil
+}
+
+func (t *RelayTransport) Subscribe(ctx context.Context, filter nostr.Filter) (<-chan *nostr.Event, error) {
+	relay, lost, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := relay.Subscribe(ctx, nostr.Filters{filter})
+	events := make(chan *nostr.Event)
+	go func() {
+		defer close(events)
+		defer cancel()
+		for {
+			select {
+			case evt, ok := <-sub.Events:
+				if !ok {
+					return
+				}
+				select {
+				case events <- evt:
+				case <-ctx.Done():
+					return
+				}
+			case <-lost:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Close disconnects from the relay, ending the subscriptions.
+func (t *RelayTransport) Close() {
+	t.mutex.Lock()
+	relay := t.relay
+	t.mutex.Unlock()
+	if relay != nil {
+		t.disconnect(relay)
+	}
+}
+
+// connect returns the current connection to the relay, opening it if needed,
+// and a channel closed when it is lost.
+func (t *RelayTransport) connect(ctx context.Context) (*nostr.Relay, chan struct{}, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.relay != nil {
+		return t.relay, t.lost, nil
+	}
+
+	relay, err := nostr.RelayConnect(ctx, t.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	lost := make(chan struct{})
+	t.relay, t.lost = relay, lost
+
+	// Notices and errors must be read for the connection to keep reading
+	go func() {
+		for {
+			select {
+			case notice := <-relay.Notices:
+				log.Printf("notice from %s: %s", t.URL, notice)
+			case err := <-relay.ConnectionError:
+				if t.disconnect(relay) {
+					log.Printf("lost connection to %s: %v", t.URL, err)
+				}
+				return
+			case <-lost:
+				return
+			}
+		}
+	}()
+
+	return relay, lost, nil
+}
+
+// disconnect closes the given connection if it is still the current one,
+// reporting whether it was.
+func (t *RelayTransport) disconnect(relay *nostr.Relay) bool {
+	t.mutex.Lock()
+	if t.relay != relay {
+		t.mutex.Unlock()
+		return false
+	}
+	lost := t.lost
+	t.relay, t.lost = nil, nil
+	t.mutex.Unlock()
+	_ = relay.Close()
+	close(lost)
+	return true
+}
@@ -0,0 +1,71 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"time"
+)
+
+// ErrWrongKey is returned when the private key found for an event doesn't
+// match its public key.
+var ErrWrongKey = errors.New("private key doesn't match the public key of the event")
+
+// Signer signs events on behalf of the public key they are authored by, setting
+// their id and signature.
+type Signer interface {
+	Sign(ctx context.Context, evt *nostr.Event) error
+}
+
+// KindHTTPAuth is the kind of the NIP-98 events authenticating HTTP requests.
+const KindHTTPAuth = 27235
+
+// Routed signs each event with the signer it returns for the public key of the
+// event, so keys held in different places can be used together.
+type Routed func(pubkey string) (Signer, error)
+
+func (route Routed) Sign(ctx context.Context, evt *nostr.Event) error {
+	s, err := route(evt.PubKey)
+	if err != nil {
+		return err
+	}
+	return s.Sign(ctx, evt)
+}
+
+// Prove checks that a signer holds the key of pubkey by having it sign a NIP-98
+// authentication of a POST request to the given url.
+func Prove(ctx context.Context, s Signer, pubkey string, url string) error {
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: time.Now(),
+		Kind:      KindHTTPAuth,
+		Tags:      nostr.Tags{{"u", url}, {"method", "POST"}},
+	}
+	if err := s.Sign(ctx, &evt); err != nil {
+		return err
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok || evt.ID != evt.GetID() {
+		return fmt.Errorf("the signer doesn't hold the key of %s", pubkey)
+	}
+	return nil
+}
+
+// KeyFunc returns the private key of the given public key.
+type KeyFunc func(pubkey string) (string, error)
+
+// Local signs events in this process with the private keys returned by Key.
+type Local struct {
+	Key KeyFunc
+}
+
+func (s *Local) Sign(_ context.Context, evt *nostr.Event) error {
+	sk, err := s.Key(evt.PubKey)
+	if err != nil {
+		return fmt.Errorf("no private key for %s: %w", evt.PubKey, err)
+	}
+	if pk, err := nostr.GetPublicKey(sk); err != nil || pk != evt.PubKey {
+		return ErrWrongKey
+	}
+	return evt.Sign(sk)
+}
@@ -0,0 +1,100 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+const samplePubKey = "1870bcd5f6081ef7ea4b17204ffa4e92de51670142be0c8140e0635b355ca85f"
+const samplePrivateKey = "27660ab89e69f59bb8d9f0bd60da4a8515cdd3e2ca4f91d72a242b086d6aaaa7"
+
+func sampleKeys(pubkey string) (string, error) {
+	if pubkey == samplePubKey {
+		return samplePrivateKey, nil
+	}
+	return "", errors.New("unknown")
+}
+
+func sampleEvent(pubkey string) nostr.Event {
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: time.Unix(1672531200, 0),
+		Kind:      nostr.KindTextNote,
+		Tags:      nostr.Tags{{"t", "nostr"}},
+		Content:   "Hello",
+	}
+}
+
+func TestLocalSignsWithTheKeyOfTheAuthor(t *testing.T) {
+	s := &Local{Key: sampleKeys}
+
+	evt := sampleEvent(samplePubKey)
+	assert.NoError(t, s.Sign(context.Background(), &evt))
+	assert.Equal(t, evt.GetID(), evt.ID)
+	ok, err := evt.CheckSignature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	other := sampleEvent(pubkey)
+	assert.Error(t, s.Sign(context.Background(), &other))
+	assert.Empty(t, other.Sig)
+}
+
+func TestLocalRefusesKeysOfAnotherAuthor(t *testing.T) {
+	s := &Local{Key: func(string) (string, error) { return samplePrivateKey, nil }}
+
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	evt := sampleEvent(pubkey)
+	assert.ErrorIs(t, s.Sign(context.Background(), &evt), ErrWrongKey)
+	assert.Empty(t, evt.Sig)
+}
+
+func TestProveRequiresTheKey(t *testing.T) {
+	s := &Local{Key: sampleKeys}
+	assert.NoError(t, Prove(context.Background(), s, samplePubKey, "https://rsslay.example/create"))
+
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	assert.Error(t, Prove(context.Background(), s, pubkey, "https://rsslay.example/create"))
+
+	// Signatures are checked, not trusted
+	forged := signerFunc(func(_ context.Context, evt *nostr.Event) error {
+		evt.ID, evt.Sig = evt.GetID(), strings.Repeat("0", 128)
+		return nil
+	})
+	assert.Error(t, Prove(context.Background(), forged, samplePubKey, "https://rsslay.example/create"))
+}
+
+func TestRoutedSignsWithTheSignerOfEachKey(t *testing.T) {
+	other := nostr.GeneratePrivateKey()
+	otherPubKey, _ := nostr.GetPublicKey(other)
+	s := Routed(func(pubkey string) (Signer, error) {
+		switch pubkey {
+		case samplePubKey:
+			return &Local{Key: sampleKeys}, nil
+		case otherPubKey:
+			return &Local{Key: func(string) (string, error) { return other, nil }}, nil
+		}
+		return nil, errors.New("no signer")
+	})
+
+	for _, pubkey := range []string{samplePubKey, otherPubKey} {
+		evt := sampleEvent(pubkey)
+		assert.NoError(t, s.Sign(context.Background(), &evt))
+		ok, _ := evt.CheckSignature()
+		assert.True(t, ok)
+	}
+	unknown := sampleEvent("unknown")
+	assert.ErrorContains(t, s.Sign(context.Background(), &unknown), "no signer")
+}
+
+type signerFunc func(ctx context.Context, evt *nostr.Event) error
+
+func (f signerFunc) Sign(ctx context.Context, evt *nostr.Event) error {
+	return f(ctx, evt)
+}
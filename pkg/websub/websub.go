@@ -0,0 +1,355 @@
+package websub
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subscription states.
+const (
+	StatePending  = "pending"
+	StateActive   = "active"
+	StateDenied   = "denied"
+	StateInactive = "inactive"
+)
+
+// defaultVerifyTimeout is how long hubs are given to verify a request when the
+// subscriber doesn't set VerifyTimeout.
+const defaultVerifyTimeout = time.Hour
+
+// maxContentLength is the maximum size of a notification body accepted from a hub.
+const maxContentLength = 5 << 20
+
+// ContentHandler processes the content pushed by a hub for the feed with the
+// given public key.
+type ContentHandler func(pubkey string, content io.Reader) error
+
+// Subscriber subscribes feeds to the WebSub hubs they advertise and receives
+// their notifications, so new items arrive without waiting for the next poll.
+// Subscriptions are stored in the database, one per feed.
+type Subscriber struct {
+	DB *sql.DB
+	// CallbackURL is the public base url of the callback route, to which the
+	// public key of each feed is appended.
+	CallbackURL string
+	// LeaseSeconds is the lease requested to hubs, which may choose another one.
+	LeaseSeconds int
+	// RenewBefore is how long before the lease expires it is renewed.
+	RenewBefore time.Duration
+	// VerifyTimeout is how long the hub has to verify a request before it is
+	// sent again, as verifications can be lost.
+	VerifyTimeout time.Duration
+	// OnContent is called with the body of every verified notification.
+	OnContent ContentHandler
+	Client    *http.Client
+}
+
+// EnsureSubscribed subscribes the feed to the hub unless it already has a
+// subscription on that hub and topic which doesn't need to be requested again.
+func (s *Subscriber) EnsureSubscribed(pubkey string, hub string, topic string) error {
+	if hub == "" {
+		return nil
+	}
+
+	var sub subscription
+	row := s.DB.QueryRow(`SELECT publickey, hub, topic, state, lease_expires_at, pending_secret, requested_at FROM websub_subscriptions WHERE publickey=?`, pubkey)
+	err := row.Scan(&sub.pubkey, &sub.hub, &sub.topic, &sub.state, &sub.leaseExpiresAt, &sub.pendingSecret, &sub.requestedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to retrieve subscription of %s: %w", pubkey, err)
+	}
+
+	if err == nil && sub.hub == hub && sub.topic == topic && !s.needsRequest(sub, time.Now()) {
+		return nil
+	}
+
+	return s.Subscribe(pubkey, hub, topic)
+}
+
+// RenewSubscriptions requests again the subscriptions whose lease is about to
+// expire or whose verification was lost, whether their feeds change or not,
+// returning how many were requested.
+func (s *Subscriber) RenewSubscriptions() (int, error) {
+	rows, err := s.DB.Query(`SELECT publickey, hub, topic, state, lease_expires_at, pending_secret, requested_at FROM websub_subscriptions WHERE state IN (?, ?)`, StateActive, StatePending)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve subscriptions: %w", err)
+	}
+
+	var due []subscription
+	now := time.Now()
+	for rows.Next() {
+		var sub subscription
+		if err := rows.Scan(&sub.pubkey, &sub.hub, &sub.topic, &sub.state, &sub.leaseExpiresAt, &sub.pendingSecret, &sub.requestedAt); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		if s.needsRequest(sub, now) {
+			due = append(due, sub)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	renewed := 0
+	for _, sub := range due {
+		if err := s.Subscribe(sub.pubkey, sub.hub, sub.topic); err != nil {
+			log.Printf("websub: failed to renew subscription to %q: %v", sub.topic, err)
+			continue
+		}
+		renewed++
+	}
+	return renewed, nil
+}
+
+type subscription struct {
+	pubkey         string
+	hub            string
+	topic          string
+	state          string
+	leaseExpiresAt int64
+	pendingSecret  string
+	requestedAt    int64
+}
+
+// needsRequest tells whether a subscription must be requested again: when the
+// lease is about to expire, or when the hub didn't verify the last request in
+// time. Denied subscriptions are not insisted on.
+func (s *Subscriber) needsRequest(sub subscription, now time.Time) bool {
+	verifyTimeout := s.VerifyTimeout
+	if verifyTimeout <= 0 {
+		verifyTimeout = defaultVerifyTimeout
+	}
+	if sub.pendingSecret != "" && now.Before(time.Unix(sub.requestedAt, 0).Add(verifyTimeout)) {
+		// Wait for the hub to verify
+		return false
+	}
+
+	switch sub.state {
+	case StateActive:
+		return !time.Unix(sub.leaseExpiresAt, 0).After(now.Add(s.RenewBefore))
+	case StateDenied:
+		return false
+	default:
+		return true
+	}
+}
+
+// Subscribe sends a subscription request for the topic to the hub. The hub
+// verifies it asynchronously by calling the callback. Active subscriptions
+// being renewed stay active with their secret until the hub verifies again.
+func (s *Subscriber) Subscribe(pubkey string, hub string, topic string) error {
+	secret, err := newSecret()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.DB.Exec(`INSERT INTO websub_subscriptions (publickey, hub, topic, secret, pending_secret, state, lease_expires_at, requested_at) VALUES (?, ?, ?, '', ?, ?, 0, ?)
+		ON CONFLICT(publickey) DO UPDATE SET
+			state=CASE WHEN state=? AND hub=excluded.hub AND topic=excluded.topic THEN state ELSE excluded.state END,
+			hub=excluded.hub, topic=excluded.topic, pending_secret=excluded.pending_secret, requested_at=excluded.requested_at`,
+		pubkey, hub, topic, secret, StatePending, time.Now().Unix(), StateActive); err != nil {
+		return fmt.Errorf("failed to store subscription of %s: %w", pubkey, err)
+	}
+
+	return s.request(hub, url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {topic},
+		"hub.callback":      {s.callback(pubkey)},
+		"hub.secret":        {secret},
+		"hub.lease_seconds": {strconv.Itoa(s.LeaseSeconds)},
+	})
+}
+
+// Unsubscribe asks the hub to stop sending notifications for the feed.
+func (s *Subscriber) Unsubscribe(pubkey string) error {
+	var hub, topic string
+	row := s.DB.QueryRow(`SELECT hub, topic FROM websub_subscriptions WHERE publickey=?`, pubkey)
+	if err := row.Scan(&hub, &topic); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := s.DB.Exec(`UPDATE websub_subscriptions SET state=? WHERE publickey=?`, StateInactive, pubkey); err != nil {
+		return err
+	}
+
+	return s.request(hub, url.Values{
+		"hub.mode":     {"unsubscribe"},
+		"hub.topic":    {topic},
+		"hub.callback": {s.callback(pubkey)},
+	})
+}
+
+// HandleCallback answers the verification of intent requests from hubs and
+// receives their content notifications for the feed with the given public key.
+func (s *Subscriber) HandleCallback(w http.ResponseWriter, r *http.Request, pubkey string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleVerification(w, r, pubkey)
+	case http.MethodPost:
+		s.handleNotification(w, r, pubkey)
+	default:
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Subscriber) handleVerification(w http.ResponseWriter, r *http.Request, pubkey string) {
+	query := r.URL.Query()
+	mode := query.Get("hub.mode")
+	topic := query.Get("hub.topic")
+
+	var storedTopic, state, pendingSecret string
+	row := s.DB.QueryRow(`SELECT topic, state, pending_secret FROM websub_subscriptions WHERE publickey=?`, pubkey)
+	if err := row.Scan(&storedTopic, &state, &pendingSecret); err != nil || storedTopic != topic {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch mode {
+	case "subscribe":
+		// Only requests still waiting for their verification are confirmed
+		if pendingSecret == "" || (state != StatePending && state != StateActive) {
+			http.NotFound(w, r)
+			return
+		}
+		lease, _ := strconv.Atoi(query.Get("hub.lease_seconds"))
+		if lease <= 0 {
+			lease = s.LeaseSeconds
+		}
+		expiresAt := time.Now().Add(time.Duration(lease) * time.Second).Unix()
+		// The secret sent with the verified request is used from now on
+		if _, err := s.DB.Exec(`UPDATE websub_subscriptions SET state=?, lease_expires_at=?, secret=CASE WHEN pending_secret<>'' THEN pending_secret ELSE secret END, pending_secret='' WHERE publickey=?`, StateActive, expiresAt, pubkey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("websub: subscribed to %q for %d seconds", topic, lease)
+	case "unsubscribe":
+		if state != StateInactive {
+			http.NotFound(w, r)
+			return
+		}
+		// Subscriptions of deleted feeds are not needed anymore
+		if _, err := s.DB.Exec(`DELETE FROM websub_subscriptions WHERE publickey=? AND NOT EXISTS (SELECT 1 FROM feeds WHERE publickey=?)`, pubkey, pubkey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "denied":
+		if _, err := s.DB.Exec(`UPDATE websub_subscriptions SET state=?, pending_secret='' WHERE publickey=?`, StateDenied, pubkey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("websub: subscription to %q denied: %s", topic, query.Get("hub.reason"))
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		http.Error(w, "Unknown mode", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(query.Get("hub.challenge")))
+}
+
+func (s *Subscriber) handleNotification(w http.ResponseWriter, r *http.Request, pubkey string) {
+	var secret, pendingSecret, state string
+	row := s.DB.QueryRow(`SELECT secret, pending_secret, state FROM websub_subscriptions WHERE publickey=?`, pubkey)
+	if err := row.Scan(&secret, &pendingSecret, &state); err != nil || state != StateActive {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxContentLength))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Hubs expect a success response even when the signature doesn't match,
+	// the content is just ignored. While a renewal is verified, the hub may
+	// already sign with the new secret.
+	w.WriteHeader(http.StatusAccepted)
+	signature := r.Header.Get("X-Hub-Signature")
+	if !validSignature(signature, secret, body) && (pendingSecret == "" || !validSignature(signature, pendingSecret, body)) {
+		log.Printf("websub: ignored notification with invalid signature for %s", pubkey)
+		return
+	}
+
+	if err := s.OnContent(pubkey, bytes.NewReader(body)); err != nil {
+		log.Printf("websub: failed to process notification for %s: %v", pubkey, err)
+	}
+}
+
+func (s *Subscriber) callback(pubkey string) string {
+	return strings.TrimSuffix(s.CallbackURL, "/") + "/" + pubkey
+}
+
+func (s *Subscriber) request(hub string, form url.Values) error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.PostForm(hub, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("hub %s answered %s to %s request", hub, resp.Status, form.Get("hub.mode"))
+	}
+	return nil
+}
+
+func validSignature(header string, secret string, body []byte) bool {
+	method, signature, found := strings.Cut(header, "=")
+	if !found {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch method {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha384":
+		h = sha512.New384
+	case "sha512":
+		h = sha512.New
+	default:
+		return false
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	m := hmac.New(h, []byte(secret))
+	m.Write(body)
+	return hmac.Equal(m.Sum(nil), expected)
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
@@ -0,0 +1,241 @@
+package websub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/piraces/rsslay/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const samplePubKey = "1870bcd5f6081ef7ea4b17204ffa4e92de51670142be0c8140e0635b355ca85f"
+const sampleTopic = "https://blog.example/feed.xml"
+const sampleContent = `<rss version="2.0"><channel><title>Blog</title></channel></rss>`
+
+// fakeHub verifies subscriptions against the callback synchronously and keeps
+// the secret to sign notifications afterwards.
+type fakeHub struct {
+	t         *testing.T
+	secret    string
+	callback  string
+	challenge string
+	verified  bool
+	// requests is the number of requests received, and silent ones are not
+	// verified, as if the verification was lost.
+	requests int
+	silent   bool
+}
+
+func (h *fakeHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	h.requests++
+	if h.silent {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	h.secret = r.Form.Get("hub.secret")
+	h.callback = r.Form.Get("hub.callback")
+
+	query := url.Values{
+		"hub.mode":          {r.Form.Get("hub.mode")},
+		"hub.topic":         {r.Form.Get("hub.topic")},
+		"hub.challenge":     {h.challenge},
+		"hub.lease_seconds": {"3600"},
+	}
+	resp, err := http.Get(h.callback + "?" + query.Encode())
+	if err != nil {
+		h.t.Errorf("an error '%s' was not expected when verifying intent", err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	h.verified = resp.StatusCode == http.StatusOK && string(body) == h.challenge
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *fakeHub) publish(content string, secret string) *http.Response {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(content))
+	req, _ := http.NewRequest(http.MethodPost, h.callback, strings.NewReader(content))
+	req.Header.Set("Content-Type", "application/rss+xml")
+	req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("an error '%s' was not expected when publishing", err)
+	}
+	_ = resp.Body.Close()
+	return resp
+}
+
+func setup(t *testing.T) (*Subscriber, *fakeHub, string, *[]string) {
+	db := testdb.Open(t)
+
+	var mutex sync.Mutex
+	var received []string
+	subscriber := &Subscriber{
+		DB:           db,
+		LeaseSeconds: 86400,
+		OnContent: func(pubkey string, content io.Reader) error {
+			body, _ := io.ReadAll(content)
+			mutex.Lock()
+			defer mutex.Unlock()
+			received = append(received, pubkey+":"+string(body))
+			return nil
+		},
+	}
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriber.HandleCallback(w, r, strings.TrimPrefix(r.URL.Path, "/websub/"))
+	}))
+	t.Cleanup(callbackServer.Close)
+	subscriber.CallbackURL = callbackServer.URL + "/websub/"
+
+	hub := &fakeHub{t: t, challenge: "challenge-123"}
+	hubServer := httptest.NewServer(hub)
+	t.Cleanup(hubServer.Close)
+
+	return subscriber, hub, hubServer.URL, &received
+}
+
+func TestSubscribeVerifiesIntentAndReceivesSignedContent(t *testing.T) {
+	subscriber, hub, hubUrl, received := setup(t)
+
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.True(t, hub.verified)
+	assert.Equal(t, subscriber.CallbackURL+samplePubKey, hub.callback)
+
+	resp := hub.publish(sampleContent, hub.secret)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, []string{samplePubKey + ":" + sampleContent}, *received)
+}
+
+func TestNotificationWithInvalidSignatureIsIgnored(t *testing.T) {
+	subscriber, hub, hubUrl, received := setup(t)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+
+	resp := hub.publish(sampleContent, "not the secret")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Empty(t, *received)
+}
+
+func TestEnsureSubscribedDoesNotResubscribeActiveLeases(t *testing.T) {
+	subscriber, hub, hubUrl, _ := setup(t)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	secret := hub.secret
+
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.Equal(t, secret, hub.secret)
+
+	// Leases about to expire are renewed
+	subscriber.RenewBefore = 2 * time.Hour
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.NotEqual(t, secret, hub.secret)
+}
+
+func TestVerificationForUnknownTopicIsRejected(t *testing.T) {
+	subscriber, _, hubUrl, _ := setup(t)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+
+	resp, err := http.Get(subscriber.CallbackURL + samplePubKey + "?hub.mode=subscribe&hub.topic=https://other.example&hub.challenge=x")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestVerificationWithoutPendingRequestIsRejected(t *testing.T) {
+	subscriber, hub, hubUrl, _ := setup(t)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.True(t, hub.verified)
+
+	// The request was already verified, so the same verification is refused
+	resp, err := http.Get(subscriber.CallbackURL + samplePubKey + "?hub.mode=subscribe&hub.topic=" + url.QueryEscape(sampleTopic) + "&hub.challenge=x")
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestEnsureSubscribedWithoutHubDoesNothing(t *testing.T) {
+	subscriber, hub, _, _ := setup(t)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, "", sampleTopic))
+	assert.False(t, hub.verified)
+}
+
+func TestLostVerificationsAreRequestedAgain(t *testing.T) {
+	subscriber, hub, hubUrl, _ := setup(t)
+	hub.silent = true
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.Equal(t, 1, hub.requests)
+
+	// The hub has some time to verify
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.Equal(t, 1, hub.requests)
+
+	_, err := subscriber.DB.Exec(`UPDATE websub_subscriptions SET requested_at=? WHERE publickey=?`, time.Now().Add(-2*time.Hour).Unix(), samplePubKey)
+	assert.NoError(t, err)
+	hub.silent = false
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.Equal(t, 2, hub.requests)
+	assert.True(t, hub.verified)
+}
+
+func TestRenewedSubscriptionsStayActiveUntilVerified(t *testing.T) {
+	subscriber, hub, hubUrl, received := setup(t)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	oldSecret := hub.secret
+
+	// The renewal is not verified yet
+	hub.silent = true
+	subscriber.RenewBefore = 2 * time.Hour
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.Equal(t, 2, hub.requests)
+	hub.publish(sampleContent, oldSecret)
+	assert.Len(t, *received, 1)
+
+	// Once verified, the new secret replaces the old one
+	hub.silent = false
+	_, err := subscriber.DB.Exec(`UPDATE websub_subscriptions SET requested_at=0 WHERE publickey=?`, samplePubKey)
+	assert.NoError(t, err)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.NotEqual(t, oldSecret, hub.secret)
+	hub.publish(sampleContent, oldSecret)
+	assert.Len(t, *received, 1)
+	hub.publish(sampleContent, hub.secret)
+	assert.Len(t, *received, 2)
+}
+
+func TestRenewSubscriptionsRenewsExpiringLeases(t *testing.T) {
+	subscriber, hub, hubUrl, _ := setup(t)
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	secret := hub.secret
+
+	renewed, err := subscriber.RenewSubscriptions()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, renewed)
+
+	subscriber.RenewBefore = 2 * time.Hour
+	renewed, err = subscriber.RenewSubscriptions()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, renewed)
+	assert.NotEqual(t, secret, hub.secret)
+	assert.True(t, hub.verified)
+}
+
+func TestUnsubscribedDeletedFeedsAreForgotten(t *testing.T) {
+	subscriber, hub, hubUrl, _ := setup(t)
+	// The feed was deleted, there is no row for it in the feeds table
+	assert.NoError(t, subscriber.EnsureSubscribed(samplePubKey, hubUrl, sampleTopic))
+	assert.NoError(t, subscriber.Unsubscribe(samplePubKey))
+	assert.True(t, hub.verified)
+
+	var count int
+	assert.NoError(t, subscriber.DB.QueryRow(`SELECT COUNT(*) FROM websub_subscriptions`).Scan(&count))
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,4 @@
+ALTER TABLE feeds ADD COLUMN next_poll_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feeds ADD COLUMN last_polled_at INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS feeds_next_poll_at ON feeds (next_poll_at);
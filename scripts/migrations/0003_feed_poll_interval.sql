@@ -0,0 +1 @@
+ALTER TABLE feeds ADD COLUMN poll_interval INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS websub_subscriptions (
+   publickey VARCHAR(64) PRIMARY KEY,
+   hub TEXT NOT NULL,
+   topic TEXT NOT NULL,
+   secret TEXT NOT NULL,
+   state TEXT NOT NULL,
+   lease_expires_at INTEGER NOT NULL DEFAULT 0
+);
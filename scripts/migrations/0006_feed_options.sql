@@ -0,0 +1 @@
+ALTER TABLE feeds ADD COLUMN articles TEXT NOT NULL DEFAULT '';
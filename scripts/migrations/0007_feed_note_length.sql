@@ -0,0 +1 @@
+ALTER TABLE feeds ADD COLUMN max_note_length INTEGER NOT NULL DEFAULT 0;
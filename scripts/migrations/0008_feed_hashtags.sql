@@ -0,0 +1 @@
+ALTER TABLE feeds ADD COLUMN max_hashtags INTEGER;
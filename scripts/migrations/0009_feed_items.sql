@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS items (
+   publickey VARCHAR(64) NOT NULL,
+   item_key TEXT NOT NULL,
+   first_seen_at INTEGER NOT NULL,
+   PRIMARY KEY (publickey, item_key)
+);
@@ -0,0 +1,24 @@
+-- Full-text index of the searchable text of each event: the name and about of
+-- profiles, and the title, summary, hashtags and content of notes and articles.
+-- Rows are keyed by the rowid of their event and kept in sync by triggers.
+CREATE VIRTUAL TABLE IF NOT EXISTS events_search USING fts4(text, tokenize=unicode61);
+
+CREATE TRIGGER IF NOT EXISTS events_search_insert AFTER INSERT ON events BEGIN
+   INSERT INTO events_search (docid, text) VALUES (new.rowid, CASE
+      WHEN new.kind = 0 AND json_valid(new.content) THEN
+         IFNULL(json_extract(new.content, '$.name'), '') || ' ' || IFNULL(json_extract(new.content, '$.about'), '')
+      ELSE
+         IFNULL((SELECT group_concat(json_extract(value, '$[1]'), ' ') FROM json_each(new.tags) WHERE json_extract(value, '$[0]') IN ('title', 'summary', 't')), '') || ' ' || new.content
+   END);
+END;
+
+CREATE TRIGGER IF NOT EXISTS events_search_delete AFTER DELETE ON events BEGIN
+   DELETE FROM events_search WHERE docid = old.rowid;
+END;
+
+INSERT INTO events_search (docid, text) SELECT rowid, CASE
+   WHEN kind = 0 AND json_valid(content) THEN
+      IFNULL(json_extract(content, '$.name'), '') || ' ' || IFNULL(json_extract(content, '$.about'), '')
+   ELSE
+      IFNULL((SELECT group_concat(json_extract(value, '$[1]'), ' ') FROM json_each(events.tags) WHERE json_extract(value, '$[0]') IN ('title', 'summary', 't')), '') || ' ' || content
+END FROM events;
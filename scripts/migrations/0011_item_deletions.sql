@@ -0,0 +1,4 @@
+ALTER TABLE feeds ADD COLUMN delete_missing_items INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE items ADD COLUMN last_seen_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE items ADD COLUMN deleted_at INTEGER NOT NULL DEFAULT 0;
+UPDATE items SET last_seen_at = first_seen_at;
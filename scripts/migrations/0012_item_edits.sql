@@ -0,0 +1,2 @@
+ALTER TABLE feeds ADD COLUMN edits TEXT NOT NULL DEFAULT '';
+ALTER TABLE items ADD COLUMN version TEXT NOT NULL DEFAULT '';
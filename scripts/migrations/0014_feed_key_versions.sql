@@ -0,0 +1,10 @@
+ALTER TABLE feeds ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS key_rotations (
+   url TEXT NOT NULL,
+   old_publickey VARCHAR(64) NOT NULL,
+   old_key_version INTEGER NOT NULL,
+   new_publickey VARCHAR(64) NOT NULL,
+   new_key_version INTEGER NOT NULL,
+   rotated_at INTEGER NOT NULL
+);
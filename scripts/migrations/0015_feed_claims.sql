@@ -0,0 +1,12 @@
+ALTER TABLE feeds ADD COLUMN owner VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE feeds ADD COLUMN delegation TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS feed_claims (
+   token TEXT PRIMARY KEY,
+   publickey VARCHAR(64) NOT NULL,
+   owner VARCHAR(64) NOT NULL,
+   created_at INTEGER NOT NULL,
+   verified_at INTEGER NOT NULL DEFAULT 0,
+   completed_at INTEGER NOT NULL DEFAULT 0,
+   handover TEXT NOT NULL DEFAULT ''
+);
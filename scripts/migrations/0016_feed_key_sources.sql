@@ -0,0 +1,2 @@
+ALTER TABLE feeds ADD COLUMN key_source TEXT NOT NULL DEFAULT 'derived';
+ALTER TABLE feeds ADD COLUMN bunker TEXT NOT NULL DEFAULT '';
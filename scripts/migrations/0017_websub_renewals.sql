@@ -0,0 +1,2 @@
+ALTER TABLE websub_subscriptions ADD COLUMN pending_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE websub_subscriptions ADD COLUMN requested_at INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,37 @@
+-- The rowids of events, which have a text primary key, can change when the
+-- database is vacuumed, so the full-text index is keyed by a stable integer
+-- assigned to each event id instead.
+DROP TRIGGER IF EXISTS events_search_insert;
+DROP TRIGGER IF EXISTS events_search_delete;
+DROP TABLE IF EXISTS events_search;
+
+CREATE TABLE IF NOT EXISTS events_search_ids (
+   docid INTEGER PRIMARY KEY AUTOINCREMENT,
+   id VARCHAR(64) NOT NULL UNIQUE
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS events_search USING fts4(text, tokenize=unicode61);
+
+CREATE TRIGGER IF NOT EXISTS events_search_insert AFTER INSERT ON events BEGIN
+   INSERT OR IGNORE INTO events_search_ids (id) VALUES (new.id);
+   INSERT INTO events_search (docid, text) VALUES ((SELECT docid FROM events_search_ids WHERE id = new.id), CASE
+      WHEN new.kind = 0 AND json_valid(new.content) THEN
+         IFNULL(json_extract(new.content, '$.name'), '') || ' ' || IFNULL(json_extract(new.content, '$.about'), '')
+      ELSE
+         IFNULL((SELECT group_concat(json_extract(value, '$[1]'), ' ') FROM json_each(new.tags) WHERE json_extract(value, '$[0]') IN ('title', 'summary', 't')), '') || ' ' || new.content
+   END);
+END;
+
+CREATE TRIGGER IF NOT EXISTS events_search_delete AFTER DELETE ON events BEGIN
+   DELETE FROM events_search WHERE docid = (SELECT docid FROM events_search_ids WHERE id = old.id);
+   DELETE FROM events_search_ids WHERE id = old.id;
+END;
+
+INSERT OR IGNORE INTO events_search_ids (id) SELECT id FROM events;
+
+INSERT INTO events_search (docid, text) SELECT events_search_ids.docid, CASE
+   WHEN kind = 0 AND json_valid(content) THEN
+      IFNULL(json_extract(content, '$.name'), '') || ' ' || IFNULL(json_extract(content, '$.about'), '')
+   ELSE
+      IFNULL((SELECT group_concat(json_extract(value, '$[1]'), ' ') FROM json_each(events.tags) WHERE json_extract(value, '$[0]') IN ('title', 'summary', 't')), '') || ' ' || content
+END FROM events JOIN events_search_ids ON events_search_ids.id = events.id;
@@ -2,4 +2,18 @@ CREATE TABLE IF NOT EXISTS feeds (
    publickey VARCHAR(64) PRIMARY KEY,
    privatekey VARCHAR(64) NOT NULL,
    url TEXT NOT NULL
-);
\ No newline at end of file
+);
+
+CREATE TABLE IF NOT EXISTS events (
+   id VARCHAR(64) PRIMARY KEY,
+   pubkey VARCHAR(64) NOT NULL,
+   kind INTEGER NOT NULL,
+   created_at INTEGER NOT NULL,
+   tags TEXT NOT NULL,
+   content TEXT NOT NULL,
+   sig VARCHAR(128) NOT NULL,
+   guid TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS events_pubkey_kind_created_at ON events (pubkey, kind, created_at);
+CREATE INDEX IF NOT EXISTS events_created_at ON events (created_at);
@@ -1,6 +1,60 @@
 package scripts
 
-import _ "embed"
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+)
 
 //go:embed schema.sql
 var SchemaSQL string
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migrate creates the base schema and applies, in order, the migrations not yet
+// applied to the database. The number of applied migrations is tracked in the
+// SQLite user_version pragma.
+func Migrate(db *sql.DB) error {
+	if _, err := db.Exec(SchemaSQL); err != nil {
+		return fmt.Errorf("cannot create schema: %w", err)
+	}
+
+	files, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("cannot read schema version: %w", err)
+	}
+
+	for i := version; i < len(files); i++ {
+		migration, err := migrations.ReadFile(files[i])
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(migration)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("cannot apply migration %s: %w", files[i], err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("cannot update schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}